@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+)
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// 公開用のソケットとは別のアドレスで待ち受ける管理用のサーバー
+// メトリクスとログレベルの変更を提供する
+func newAdminServer(app *echo.Echo) *echo.Echo {
+	admin := echo.New()
+	admin.HideBanner = true
+	admin.HidePort = true
+	admin.Logger.SetLevel(log.OFF)
+	admin.Use(middleware.Recover())
+
+	admin.GET("/metrics", getMetrics)
+
+	// GET /log_level
+	// 現在のログレベルを取得
+	admin.GET("/log_level", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, LogLevelResponse{Level: logLevelName(app.Logger.Level())})
+	})
+
+	// PUT /log_level
+	// 再起動せずにログレベルを変更
+	admin.PUT("/log_level", func(c echo.Context) error {
+		var req LogLevelRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad request body")
+		}
+		lvl, err := parseLogLevel(req.Level)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: level")
+		}
+
+		setLogLevel(app, lvl)
+		return c.JSON(http.StatusOK, LogLevelResponse{Level: logLevelName(lvl)})
+	})
+
+	return admin
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// 指定した項目がtrueのコンディションがCount回続いたら発火
+	alertRuleTypeConsecutive = "consecutive"
+	// Level以上に深刻なコンディションがDuration秒以上続いたら発火
+	alertRuleTypeLevelDuration = "level_duration"
+	// Duration秒以上コンディションが届かなかったら発火
+	alertRuleTypeNoReport = "no_report"
+
+	alertStateFiring   = "firing"
+	alertStateResolved = "resolved"
+
+	alertCheckInterval = 5 * time.Second
+	alertMaxLimit      = 1000
+)
+
+var conditionLevelSeverity = map[string]int{
+	conditionLevelInfo:     0,
+	conditionLevelWarning:  1,
+	conditionLevelCritical: 2,
+}
+
+// ユーザーが定義したアラートのルール
+type AlertRule struct {
+	ID        int64  `db:"id" json:"id"`
+	JIAUserID string `db:"jia_user_id" json:"-"`
+	// 空ならユーザーの全てのISUが対象
+	JIAIsuUUID *string `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Name       string  `db:"name" json:"name"`
+	Type       string  `db:"type" json:"type"`
+	// consecutiveで見るコンディションの項目
+	Condition string `db:"condition_key" json:"condition,omitempty"`
+	// level_durationで見るコンディションレベル
+	Level    string `db:"level" json:"level,omitempty"`
+	Count    int    `db:"count" json:"count,omitempty"`
+	Duration int    `db:"duration_seconds" json:"duration,omitempty"`
+}
+
+func (r *AlertRule) appliesTo(jiaUserID, jiaIsuUUID string) bool {
+	return r.JIAUserID == jiaUserID && (r.JIAIsuUUID == nil || *r.JIAIsuUUID == jiaIsuUUID)
+}
+
+func (r *AlertRule) validate() string {
+	if r.Name == "" {
+		return "missing: name"
+	}
+	switch r.Type {
+	case alertRuleTypeConsecutive:
+		if !conditionSchemas.hasKey(r.Condition) {
+			return "bad format: condition"
+		}
+		if r.Count <= 0 {
+			return "bad format: count"
+		}
+	case alertRuleTypeLevelDuration:
+		if !isValidConditionLevel(r.Level) {
+			return "bad format: level"
+		}
+		if r.Duration <= 0 {
+			return "bad format: duration"
+		}
+	case alertRuleTypeNoReport:
+		if r.Duration <= 0 {
+			return "bad format: duration"
+		}
+	default:
+		return "bad format: type"
+	}
+	return ""
+}
+
+type Alert struct {
+	ID         int64        `db:"id"`
+	RuleID     int64        `db:"rule_id"`
+	JIAIsuUUID string       `db:"jia_isu_uuid"`
+	State      string       `db:"state"`
+	FiredAt    time.Time    `db:"fired_at"`
+	ResolvedAt sql.NullTime `db:"resolved_at"`
+}
+
+type GetAlertResponse struct {
+	ID         int64  `json:"id"`
+	RuleID     int64  `json:"rule_id"`
+	RuleName   string `json:"rule_name"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	State      string `json:"state"`
+	FiredAt    int64  `json:"fired_at"`
+	ResolvedAt *int64 `json:"resolved_at"`
+}
+
+// アラートの一覧の続きを指す位置 同じfired_atのものはidで順序を決める
+type alertCursor struct {
+	FiredAt int64 `json:"t"`
+	ID      int64 `json:"i"`
+}
+
+func (c alertCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAlertCursor(s string) (alertCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return alertCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+	var c alertCursor
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return alertCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+	return c, nil
+}
+
+type alertKey struct {
+	ruleID     int64
+	jiaIsuUUID string
+}
+
+// ルールとISUの組み合わせ毎の評価の状態
+type alertRuleState struct {
+	// no_reportでルールを作成した後に初めて調べた時刻 これより前は途切れていたとみなさない
+	watchedSince time.Time
+	// 発火中か 発火中は同じルールとISUでアラートを作らない
+	firing bool
+}
+
+// 評価に使うコンディション1件分
+type alertSample struct {
+	timestamp time.Time
+	values    map[string]bool
+	severity  int
+}
+
+// ISU毎の最近のコンディション
+// 複数のwriterから順不同で届いても，時刻順に並べてから評価する
+type alertHistory struct {
+	samples []alertSample
+	// no_reportで最後にコンディションを受け付けたサーバーの時刻
+	lastReport time.Time
+}
+
+// 時刻順の位置に加える 同じ時刻のものは重複とみなして捨てる
+func (h *alertHistory) insert(sample alertSample) {
+	i := sort.Search(len(h.samples), func(i int) bool { return !h.samples[i].timestamp.Before(sample.timestamp) })
+	if i < len(h.samples) && h.samples[i].timestamp.Equal(sample.timestamp) {
+		return
+	}
+	h.samples = append(h.samples, alertSample{})
+	copy(h.samples[i+1:], h.samples[i:])
+	h.samples[i] = sample
+}
+
+// 最新のcount件とduration以内のものだけを残す
+// durationより前から続いていることが分かるよう，その直前の1件も残す
+func (h *alertHistory) prune(count int, duration time.Duration) {
+	if len(h.samples) == 0 {
+		return
+	}
+	cutoff := h.samples[len(h.samples)-1].timestamp.Add(-duration)
+	keep := sort.Search(len(h.samples), func(i int) bool { return !h.samples[i].timestamp.Before(cutoff) }) - 1
+	if keep < 0 {
+		keep = 0
+	}
+	if byCount := len(h.samples) - count; byCount < keep {
+		keep = byCount
+	}
+	if keep > 0 {
+		h.samples = append([]alertSample{}, h.samples[keep:]...)
+	}
+}
+
+// DBに書き込むアラートの状態の変化
+type alertTransition struct {
+	ruleID     int64
+	jiaIsuUUID string
+	firing     bool
+	at         time.Time
+}
+
+var alertEngine = struct {
+	rules     map[int64]*AlertRule
+	states    map[alertKey]*alertRuleState
+	histories map[string]*alertHistory
+	// ISUの持ち主 ISUの持ち主は変わらないので一度引いたら使い回す
+	isuOwners map[string]string
+	// 評価の結果まだDBに書き込んでいない変化 評価した順に並ぶ
+	outbox []alertTransition
+	sync.Mutex
+}{
+	rules:     map[int64]*AlertRule{},
+	states:    map[alertKey]*alertRuleState{},
+	histories: map[string]*alertHistory{},
+	isuOwners: map[string]string{},
+}
+
+var (
+	// アラートのDBへの書き込みを評価した順に1つずつ行うためのロック
+	// 評価中はalertEngineのロックだけを取り，DBを待つ間は評価を止めない
+	alertWriter sync.Mutex
+	// outboxに変化が積まれたことをalertTickerに知らせる
+	alertNotify = make(chan struct{}, 1)
+)
+
+// DBからルールと発火中のアラートを読み込んで評価の状態を作り直す
+func loadAlertRules() error {
+	rules := []*AlertRule{}
+	err := db.Select(&rules, "SELECT `id`, `jia_user_id`, `jia_isu_uuid`, `name`, `type`, `condition_key`, `level`, `count`, `duration_seconds` FROM `alert_rule`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	firing := []Alert{}
+	err = db.Select(&firing, "SELECT * FROM `alert` WHERE `state` = ?", alertStateFiring)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	alertWriter.Lock()
+	defer alertWriter.Unlock()
+	alertEngine.Lock()
+	defer alertEngine.Unlock()
+
+	alertEngine.rules = map[int64]*AlertRule{}
+	for _, rule := range rules {
+		alertEngine.rules[rule.ID] = rule
+	}
+	alertEngine.states = map[alertKey]*alertRuleState{}
+	for _, alert := range firing {
+		alertState(alert.RuleID, alert.JIAIsuUUID).firing = true
+	}
+	alertEngine.histories = map[string]*alertHistory{}
+	alertEngine.isuOwners = map[string]string{}
+	alertEngine.outbox = nil
+	return nil
+}
+
+// ロックを取った状態で呼ぶ
+func alertState(ruleID int64, jiaIsuUUID string) *alertRuleState {
+	key := alertKey{ruleID: ruleID, jiaIsuUUID: jiaIsuUUID}
+	s, ok := alertEngine.states[key]
+	if !ok {
+		s = &alertRuleState{}
+		alertEngine.states[key] = s
+	}
+	return s
+}
+
+// ロックを取った状態で呼ぶ
+func alertIsuHistory(jiaIsuUUID string) *alertHistory {
+	h, ok := alertEngine.histories[jiaIsuUUID]
+	if !ok {
+		h = &alertHistory{}
+		alertEngine.histories[jiaIsuUUID] = h
+	}
+	return h
+}
+
+// 評価に残しておくコンディションの件数と期間 ロックを取った状態で呼ぶ
+func alertHistoryRetention() (int, time.Duration) {
+	count, duration := 1, time.Duration(0)
+	for _, rule := range alertEngine.rules {
+		switch rule.Type {
+		case alertRuleTypeConsecutive:
+			if rule.Count > count {
+				count = rule.Count
+			}
+		case alertRuleTypeLevelDuration:
+			if d := time.Duration(rule.Duration) * time.Second; d > duration {
+				duration = d
+			}
+		}
+	}
+	return count, duration
+}
+
+// まだ引いていないISUの持ち主をDBから読み込む ロックを取らずに呼ぶ
+func loadAlertIsuOwners(jiaIsuUUIDs []string) error {
+	alertEngine.Lock()
+	unknown := []string{}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if _, ok := alertEngine.isuOwners[jiaIsuUUID]; !ok {
+			unknown = append(unknown, jiaIsuUUID)
+		}
+	}
+	alertEngine.Unlock()
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	query, params, err := sqlx.In("SELECT `jia_isu_uuid`, `jia_user_id` FROM `isu` WHERE `jia_isu_uuid` IN (?)", unknown)
+	if err != nil {
+		return err
+	}
+	isus := []Isu{}
+	err = db.Select(&isus, query, params...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	alertEngine.Lock()
+	for _, isu := range isus {
+		alertEngine.isuOwners[isu.JIAIsuUUID] = isu.JIAUserID
+	}
+	alertEngine.Unlock()
+	return nil
+}
+
+// 書き込まれたコンディションでルールを評価する
+// コミットの順序はwriter毎にばらばらなので，ISU毎の最近のコンディションに時刻順に加えてから評価し直す
+// DBへの書き込みはalertTickerに任せて，コンディションの書き込みを待たせない
+func evaluateAlertRules(conditions []IsuCondition) {
+	byIsu := map[string][]IsuCondition{}
+	jiaIsuUUIDs := []string{}
+	for _, condition := range conditions {
+		if _, ok := byIsu[condition.JIAIsuUUID]; !ok {
+			jiaIsuUUIDs = append(jiaIsuUUIDs, condition.JIAIsuUUID)
+		}
+		byIsu[condition.JIAIsuUUID] = append(byIsu[condition.JIAIsuUUID], condition)
+	}
+
+	alertEngine.Lock()
+	noRules := len(alertEngine.rules) == 0
+	alertEngine.Unlock()
+	if noRules {
+		return
+	}
+
+	err := loadAlertIsuOwners(jiaIsuUUIDs)
+	if err != nil {
+		log.Errorf("failed to evaluate alert rules: %v", err)
+	}
+
+	alertEngine.Lock()
+	defer alertEngine.Unlock()
+
+	now := time.Now()
+	retainCount, retainDuration := alertHistoryRetention()
+	for jiaIsuUUID, isuConditions := range byIsu {
+		owner, ok := alertEngine.isuOwners[jiaIsuUUID]
+		if !ok {
+			continue
+		}
+
+		schema := conditionSchemas.ForIsu(jiaIsuUUID)
+		h := alertIsuHistory(jiaIsuUUID)
+		for _, condition := range isuConditions {
+			h.insert(alertSample{
+				timestamp: condition.Timestamp,
+				values:    schema.ParseStored(condition.Condition),
+				severity:  conditionLevelSeverity[condition.ConditionLevel],
+			})
+			// 受け付けた時刻はWALに残るので，復元したものや待たされたものも受け付けた時刻で数える
+			reportedAt := condition.CreatedAt
+			if reportedAt.IsZero() {
+				reportedAt = now
+			}
+			if reportedAt.After(h.lastReport) {
+				h.lastReport = reportedAt
+			}
+		}
+		h.prune(retainCount, retainDuration)
+
+		for _, rule := range alertEngine.rules {
+			if !rule.appliesTo(owner, jiaIsuUUID) {
+				continue
+			}
+			firing, at := rule.evaluate(h.samples)
+			transitionAlert(rule, jiaIsuUUID, alertState(rule.ID, jiaIsuUUID), firing, at)
+		}
+	}
+	notifyAlertTicker()
+}
+
+// 時刻順のコンディションの末尾でアラートが発火しているべきかと，その変化の時刻を返す
+func (r *AlertRule) evaluate(samples []alertSample) (bool, time.Time) {
+	last := len(samples) - 1
+	if last < 0 {
+		return false, time.Time{}
+	}
+	latest := samples[last].timestamp
+
+	switch r.Type {
+	case alertRuleTypeConsecutive:
+		run := 0
+		for i := last; i >= 0 && samples[i].values[r.Condition]; i-- {
+			run++
+		}
+		if run < r.Count {
+			return false, latest
+		}
+		// Count件目が揃った時に発火した
+		return true, samples[last-run+r.Count].timestamp
+	case alertRuleTypeLevelDuration:
+		level := conditionLevelSeverity[r.Level]
+		start := last + 1
+		for start > 0 && samples[start-1].severity >= level {
+			start--
+		}
+		if start > last {
+			return false, latest
+		}
+		since := samples[start].timestamp
+		for i := start; i <= last; i++ {
+			if samples[i].timestamp.Sub(since) >= time.Duration(r.Duration)*time.Second {
+				return true, samples[i].timestamp
+			}
+		}
+		return false, latest
+	}
+	// no_reportはコンディションが届いたので途切れていない
+	return false, latest
+}
+
+// 発火していない時だけ新しいアラートを作り，同じルールとISUで重複させない
+// 状態だけを変えてDBへの書き込みはoutboxに積む ロックを取った状態で呼ぶ
+func transitionAlert(rule *AlertRule, jiaIsuUUID string, s *alertRuleState, firing bool, at time.Time) {
+	if firing == s.firing {
+		return
+	}
+	s.firing = firing
+	alertEngine.outbox = append(alertEngine.outbox, alertTransition{
+		ruleID:     rule.ID,
+		jiaIsuUUID: jiaIsuUUID,
+		firing:     firing,
+		at:         at,
+	})
+}
+
+func notifyAlertTicker() {
+	select {
+	case alertNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (t alertTransition) write() error {
+	var err error
+	if t.firing {
+		_, err = db.Exec(
+			"INSERT INTO `alert` (`rule_id`, `jia_isu_uuid`, `state`, `fired_at`) VALUES (?, ?, ?, ?)",
+			t.ruleID, t.jiaIsuUUID, alertStateFiring, t.at)
+	} else {
+		_, err = db.Exec(
+			"UPDATE `alert` SET `state` = ?, `resolved_at` = ? WHERE `rule_id` = ? AND `jia_isu_uuid` = ? AND `state` = ?",
+			alertStateResolved, t.at, t.ruleID, t.jiaIsuUUID, alertStateFiring)
+	}
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// outboxの変化を積まれた順にDBに書き込む
+// 失敗したらそこから先をoutboxの先頭に戻して次の機会に書き込む
+func flushAlertTransitions() error {
+	alertWriter.Lock()
+	defer alertWriter.Unlock()
+
+	alertEngine.Lock()
+	pending := alertEngine.outbox
+	alertEngine.outbox = nil
+	alertEngine.Unlock()
+
+	for i, t := range pending {
+		alertEngine.Lock()
+		_, ok := alertEngine.rules[t.ruleID]
+		alertEngine.Unlock()
+		// 削除されたルールのアラートはremoveAlertRuleがまとめて解決済みにする
+		if !ok {
+			continue
+		}
+
+		err := t.write()
+		if err != nil {
+			alertEngine.Lock()
+			alertEngine.outbox = append(pending[i:len(pending):len(pending)], alertEngine.outbox...)
+			alertEngine.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// コンディションが届かないことは書き込み時に分からないので定期的に調べる
+// 評価で積まれたアラートの変化もここでDBに書き込む
+func alertTicker(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	t := time.NewTicker(alertCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// 残りはwriterが止まった後にshutdownが書き込む
+			return
+		case <-t.C:
+			err := checkNoReportAlerts(time.Now())
+			if err != nil {
+				log.Errorf("failed to check alert rules: %v", err)
+			}
+		case <-alertNotify:
+		}
+
+		err := flushAlertTransitions()
+		if err != nil {
+			log.Errorf("failed to write alerts: %v", err)
+		}
+	}
+}
+
+// 対象のISUを持たないno_reportのルールはユーザーの全てのISUを調べるので，先にまとめて引いておく
+func checkNoReportAlerts(now time.Time) error {
+	alertEngine.Lock()
+	userIDs := []string{}
+	seen := map[string]struct{}{}
+	for _, rule := range alertEngine.rules {
+		if rule.Type != alertRuleTypeNoReport || rule.JIAIsuUUID != nil {
+			continue
+		}
+		if _, ok := seen[rule.JIAUserID]; !ok {
+			seen[rule.JIAUserID] = struct{}{}
+			userIDs = append(userIDs, rule.JIAUserID)
+		}
+	}
+	alertEngine.Unlock()
+
+	userIsus := map[string][]string{}
+	if len(userIDs) > 0 {
+		query, params, err := sqlx.In("SELECT `jia_isu_uuid`, `jia_user_id` FROM `isu` WHERE `jia_user_id` IN (?)", userIDs)
+		if err != nil {
+			return err
+		}
+		isus := []Isu{}
+		err = db.Select(&isus, query, params...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		for _, isu := range isus {
+			userIsus[isu.JIAUserID] = append(userIsus[isu.JIAUserID], isu.JIAIsuUUID)
+		}
+	}
+
+	alertEngine.Lock()
+	defer alertEngine.Unlock()
+
+	for _, rule := range alertEngine.rules {
+		if rule.Type != alertRuleTypeNoReport {
+			continue
+		}
+
+		jiaIsuUUIDs := userIsus[rule.JIAUserID]
+		if rule.JIAIsuUUID != nil {
+			jiaIsuUUIDs = []string{*rule.JIAIsuUUID}
+		}
+		for _, jiaIsuUUID := range jiaIsuUUIDs {
+			s := alertState(rule.ID, jiaIsuUUID)
+			// 起動直後やルールの作成直後はここから数える
+			if s.watchedSince.IsZero() {
+				s.watchedSince = now
+				continue
+			}
+			lastReport := s.watchedSince
+			if h, ok := alertEngine.histories[jiaIsuUUID]; ok && h.lastReport.After(lastReport) {
+				lastReport = h.lastReport
+			}
+			if now.Sub(lastReport) < time.Duration(rule.Duration)*time.Second {
+				continue
+			}
+			transitionAlert(rule, jiaIsuUUID, s, true, now)
+		}
+	}
+	return nil
+}
+
+// 作成したルールを評価に加える
+func addAlertRule(rule *AlertRule) {
+	alertEngine.Lock()
+	defer alertEngine.Unlock()
+
+	alertEngine.rules[rule.ID] = rule
+}
+
+// ルールを差し替えて発火中のアラートを解決済みにし，評価をやり直す
+// 対象のISUや種類が変わると元のアラートを解決できなくなるので，更新の度に解決する
+func setAlertRule(rule *AlertRule) error {
+	return replaceAlertRule(rule.ID, rule)
+}
+
+// ルールを消して発火中のアラートを解決済みにする
+func removeAlertRule(ruleID int64) error {
+	return replaceAlertRule(ruleID, nil)
+}
+
+// ruleがnilならルールを消す
+// 書き込み中の変化が後から発火させないよう，alertWriterのロックを取ってから解決する
+func replaceAlertRule(ruleID int64, rule *AlertRule) error {
+	alertWriter.Lock()
+	defer alertWriter.Unlock()
+
+	alertEngine.Lock()
+	if rule == nil {
+		delete(alertEngine.rules, ruleID)
+	} else {
+		alertEngine.rules[ruleID] = rule
+	}
+	for key := range alertEngine.states {
+		if key.ruleID == ruleID {
+			delete(alertEngine.states, key)
+		}
+	}
+	outbox := make([]alertTransition, 0, len(alertEngine.outbox))
+	for _, t := range alertEngine.outbox {
+		if t.ruleID != ruleID {
+			outbox = append(outbox, t)
+		}
+	}
+	alertEngine.outbox = outbox
+	alertEngine.Unlock()
+
+	_, err := db.Exec("UPDATE `alert` SET `state` = ?, `resolved_at` = ? WHERE `rule_id` = ? AND `state` = ?",
+		alertStateResolved, time.Now(), ruleID, alertStateFiring)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// リクエストのルールを検証する 対象のISUはユーザーのものに限る
+func bindAlertRule(c echo.Context, jiaUserID string) (*AlertRule, int, string) {
+	rule := &AlertRule{}
+	err := c.Bind(rule)
+	if err != nil {
+		return nil, http.StatusBadRequest, "bad request body"
+	}
+	rule.JIAUserID = jiaUserID
+	if rule.JIAIsuUUID != nil && *rule.JIAIsuUUID == "" {
+		rule.JIAIsuUUID = nil
+	}
+	if errMsg := rule.validate(); errMsg != "" {
+		return nil, http.StatusBadRequest, errMsg
+	}
+
+	if rule.JIAIsuUUID != nil {
+		var count int
+		err = db.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+			jiaUserID, *rule.JIAIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return nil, http.StatusInternalServerError, ""
+		}
+		if count == 0 {
+			return nil, http.StatusNotFound, "not found: isu"
+		}
+	}
+	return rule, 0, ""
+}
+
+func getAlertRuleFromDB(ruleID int64, jiaUserID string) (*AlertRule, error) {
+	rule := &AlertRule{}
+	err := db.Get(rule,
+		"SELECT `id`, `jia_user_id`, `jia_isu_uuid`, `name`, `type`, `condition_key`, `level`, `count`, `duration_seconds`"+
+			" FROM `alert_rule` WHERE `id` = ? AND `jia_user_id` = ?",
+		ruleID, jiaUserID)
+	return rule, err
+}
+
+// GET /api/alert/rule
+// ユーザーのアラートのルールの一覧を取得
+func getAlertRules(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rules := []AlertRule{}
+	err = db.Select(&rules,
+		"SELECT `id`, `jia_user_id`, `jia_isu_uuid`, `name`, `type`, `condition_key`, `level`, `count`, `duration_seconds`"+
+			" FROM `alert_rule` WHERE `jia_user_id` = ? ORDER BY `id` ASC",
+		jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+// POST /api/alert/rule
+// アラートのルールを作成
+func postAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	rule, status, errMsg := bindAlertRule(c, jiaUserID)
+	if status != 0 {
+		if errMsg == "" {
+			return c.NoContent(status)
+		}
+		return c.String(status, errMsg)
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO `alert_rule` (`jia_user_id`, `jia_isu_uuid`, `name`, `type`, `condition_key`, `level`, `count`, `duration_seconds`)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		rule.JIAUserID, rule.JIAIsuUUID, rule.Name, rule.Type, rule.Condition, rule.Level, rule.Count, rule.Duration)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	rule.ID, err = result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	addAlertRule(rule)
+	return c.JSON(http.StatusCreated, rule)
+}
+
+func parseAlertRuleID(c echo.Context) (int64, bool) {
+	ruleID, err := strconv.ParseInt(c.Param("rule_id"), 10, 64)
+	return ruleID, err == nil
+}
+
+// GET /api/alert/rule/:rule_id
+// アラートのルールを取得
+func getAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	ruleID, ok := parseAlertRuleID(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: rule_id")
+	}
+
+	rule, err := getAlertRuleFromDB(ruleID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: rule")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, rule)
+}
+
+// PUT /api/alert/rule/:rule_id
+// アラートのルールを更新
+func putAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	ruleID, ok := parseAlertRuleID(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: rule_id")
+	}
+
+	rule, status, errMsg := bindAlertRule(c, jiaUserID)
+	if status != 0 {
+		if errMsg == "" {
+			return c.NoContent(status)
+		}
+		return c.String(status, errMsg)
+	}
+	rule.ID = ruleID
+
+	result, err := db.Exec(
+		"UPDATE `alert_rule` SET `jia_isu_uuid` = ?, `name` = ?, `type` = ?, `condition_key` = ?, `level` = ?,"+
+			" `count` = ?, `duration_seconds` = ? WHERE `id` = ? AND `jia_user_id` = ?",
+		rule.JIAIsuUUID, rule.Name, rule.Type, rule.Condition, rule.Level, rule.Count, rule.Duration, rule.ID, jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		// 変更が無い時も0になるので存在するか確かめる
+		_, err = getAlertRuleFromDB(ruleID, jiaUserID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.String(http.StatusNotFound, "not found: rule")
+			}
+
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = setAlertRule(rule)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, rule)
+}
+
+// DELETE /api/alert/rule/:rule_id
+// アラートのルールを削除 発火中のアラートは解決済みにする
+func deleteAlertRule(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	ruleID, ok := parseAlertRuleID(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: rule_id")
+	}
+
+	result, err := db.Exec("DELETE FROM `alert_rule` WHERE `id` = ? AND `jia_user_id` = ?", ruleID, jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		return c.String(http.StatusNotFound, "not found: rule")
+	}
+
+	err = removeAlertRule(ruleID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/alert
+// ユーザーのアラートを新しい順に取得 stateで発火中か解決済みかに絞り込める
+// 続きがあればX-Next-Cursorのcursorを付けて同じ条件で取得する
+func getAlerts(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	query := "SELECT `alert`.*, `alert_rule`.`name` AS `rule_name` FROM `alert`" +
+		" INNER JOIN `alert_rule` ON `alert_rule`.`id` = `alert`.`rule_id`" +
+		" WHERE `alert_rule`.`jia_user_id` = ?"
+	args := []interface{}{jiaUserID}
+	switch state := c.QueryParam("state"); state {
+	case "":
+	case alertStateFiring, alertStateResolved:
+		query += " AND `alert`.`state` = ?"
+		args = append(args, state)
+	default:
+		return c.String(http.StatusBadRequest, "bad format: state")
+	}
+
+	limit := alertMaxLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > alertMaxLimit {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		cursor, err := decodeAlertCursor(cursorStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: cursor")
+		}
+		firedAt := time.Unix(cursor.FiredAt, 0)
+		query += " AND (`alert`.`fired_at` < ? OR (`alert`.`fired_at` = ? AND `alert`.`id` < ?))"
+		args = append(args, firedAt, firedAt, cursor.ID)
+	}
+	// 続きがあるか分かるように1件多く取得する
+	query += " ORDER BY `alert`.`fired_at` DESC, `alert`.`id` DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	alerts := []struct {
+		Alert
+		RuleName string `db:"rule_name"`
+	}{}
+	err = db.Select(&alerts, query, args...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(alerts) > limit {
+		alerts = alerts[:limit]
+		last := alerts[len(alerts)-1]
+		next := alertCursor{FiredAt: last.FiredAt.Unix(), ID: last.ID}
+		c.Response().Header().Set(conditionNextCursorHeader, next.encode())
+	}
+
+	res := []GetAlertResponse{}
+	for _, a := range alerts {
+		r := GetAlertResponse{
+			ID:         a.ID,
+			RuleID:     a.RuleID,
+			RuleName:   a.RuleName,
+			JIAIsuUUID: a.JIAIsuUUID,
+			State:      a.State,
+			FiredAt:    a.FiredAt.Unix(),
+		}
+		if a.ResolvedAt.Valid {
+			resolvedAt := a.ResolvedAt.Time.Unix()
+			r.ResolvedAt = &resolvedAt
+		}
+		res = append(res, r)
+	}
+	return c.JSON(http.StatusOK, res)
+}
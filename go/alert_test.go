@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAlertIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+
+var testAlertBase = time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+
+// 評価の状態を空にしてルールを登録する テストが終わったら空に戻す
+func resetAlertEngine(t *testing.T, rules ...*AlertRule) {
+	reset := func() {
+		alertEngine.Lock()
+		alertEngine.rules = map[int64]*AlertRule{}
+		alertEngine.states = map[alertKey]*alertRuleState{}
+		alertEngine.histories = map[string]*alertHistory{}
+		alertEngine.isuOwners = map[string]string{testAlertIsuUUID: "isucon"}
+		alertEngine.outbox = nil
+		alertEngine.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+
+	alertEngine.Lock()
+	defer alertEngine.Unlock()
+	for _, rule := range rules {
+		rule.JIAUserID = "isucon"
+		alertEngine.rules[rule.ID] = rule
+	}
+}
+
+func takeAlertOutbox() []alertTransition {
+	alertEngine.Lock()
+	defer alertEngine.Unlock()
+	outbox := alertEngine.outbox
+	alertEngine.outbox = nil
+	return outbox
+}
+
+// baseからの秒で表したコンディション
+type testAlertCondition struct {
+	second int
+	dirty  bool
+	level  string
+}
+
+func (c testAlertCondition) condition() IsuCondition {
+	level := c.level
+	if level == "" {
+		level = conditionLevelInfo
+	}
+	return IsuCondition{
+		JIAIsuUUID:     testAlertIsuUUID,
+		Timestamp:      testAlertBase.Add(time.Duration(c.second) * time.Second),
+		Condition:      fmt.Sprintf("is_dirty=%v,is_overweight=false,is_broken=false", c.dirty),
+		ConditionLevel: level,
+	}
+}
+
+func TestAlertHistory(t *testing.T) {
+	tests := []struct {
+		name     string
+		inserted []int
+		count    int
+		duration time.Duration
+		want     []int
+	}{
+		{name: "in order", inserted: []int{1, 2, 3}, count: 10, want: []int{1, 2, 3}},
+		{name: "out of order", inserted: []int{3, 1, 2}, count: 10, want: []int{1, 2, 3}},
+		{name: "duplicated", inserted: []int{1, 2, 2, 1}, count: 10, want: []int{1, 2}},
+		{name: "pruned by count", inserted: []int{1, 2, 3, 4}, count: 2, want: []int{3, 4}},
+		{name: "pruned by duration", inserted: []int{1, 2, 10, 20, 30}, count: 1, duration: 15 * time.Second, want: []int{10, 20, 30}},
+		{name: "kept by count", inserted: []int{1, 2, 10, 20, 30}, count: 4, duration: 15 * time.Second, want: []int{2, 10, 20, 30}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &alertHistory{}
+			for _, second := range tt.inserted {
+				h.insert(alertSample{timestamp: testAlertBase.Add(time.Duration(second) * time.Second)})
+			}
+			h.prune(tt.count, tt.duration)
+
+			got := []int{}
+			for _, s := range h.samples {
+				got = append(got, int(s.timestamp.Sub(testAlertBase)/time.Second))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("samples = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 順不同に届いたコンディションも時刻順に評価し，発火と解決を一度ずつ積む
+func TestEvaluateAlertRules(t *testing.T) {
+	type transition struct {
+		firing bool
+		second int
+	}
+
+	tests := []struct {
+		name    string
+		rule    *AlertRule
+		batches [][]testAlertCondition
+		want    []transition
+	}{
+		{
+			name: "consecutive fires once",
+			rule: &AlertRule{ID: 1, Type: alertRuleTypeConsecutive, Condition: "is_dirty", Count: 2},
+			batches: [][]testAlertCondition{
+				{{second: 1, dirty: true}, {second: 2, dirty: true}},
+				{{second: 3, dirty: true}},
+			},
+			want: []transition{{firing: true, second: 2}},
+		},
+		{
+			name: "consecutive resolves",
+			rule: &AlertRule{ID: 1, Type: alertRuleTypeConsecutive, Condition: "is_dirty", Count: 2},
+			batches: [][]testAlertCondition{
+				{{second: 1, dirty: true}, {second: 2, dirty: true}},
+				{{second: 3, dirty: false}},
+			},
+			want: []transition{{firing: true, second: 2}, {firing: false, second: 3}},
+		},
+		{
+			name: "consecutive out of order batches",
+			rule: &AlertRule{ID: 1, Type: alertRuleTypeConsecutive, Condition: "is_dirty", Count: 3},
+			batches: [][]testAlertCondition{
+				{{second: 1, dirty: true}, {second: 3, dirty: true}},
+				{{second: 2, dirty: true}},
+			},
+			want: []transition{{firing: true, second: 3}},
+		},
+		{
+			name: "consecutive broken by late condition",
+			rule: &AlertRule{ID: 1, Type: alertRuleTypeConsecutive, Condition: "is_dirty", Count: 2},
+			batches: [][]testAlertCondition{
+				{{second: 1, dirty: true}},
+				{{second: 3, dirty: true}},
+				{{second: 2, dirty: false}},
+			},
+			// 間に届いたコンディションで続いていなかったと分かれば解決する
+			want: []transition{{firing: true, second: 3}, {firing: false, second: 3}},
+		},
+		{
+			name: "level duration",
+			rule: &AlertRule{ID: 1, Type: alertRuleTypeLevelDuration, Level: conditionLevelWarning, Duration: 60},
+			batches: [][]testAlertCondition{
+				{{second: 0, level: conditionLevelWarning}, {second: 30, level: conditionLevelCritical}},
+				{{second: 60, level: conditionLevelWarning}},
+				{{second: 90, level: conditionLevelInfo}},
+			},
+			want: []transition{{firing: true, second: 60}, {firing: false, second: 90}},
+		},
+		{
+			name: "level duration interrupted",
+			rule: &AlertRule{ID: 1, Type: alertRuleTypeLevelDuration, Level: conditionLevelCritical, Duration: 60},
+			batches: [][]testAlertCondition{
+				{{second: 0, level: conditionLevelCritical}, {second: 30, level: conditionLevelWarning}},
+				{{second: 60, level: conditionLevelCritical}},
+			},
+			want: []transition{},
+		},
+		{
+			name: "other isu",
+			rule: &AlertRule{ID: 1, JIAIsuUUID: stringPtr("other"), Type: alertRuleTypeConsecutive, Condition: "is_dirty", Count: 1},
+			batches: [][]testAlertCondition{
+				{{second: 1, dirty: true}},
+			},
+			want: []transition{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetAlertEngine(t, tt.rule)
+
+			for _, batch := range tt.batches {
+				conditions := []IsuCondition{}
+				for _, c := range batch {
+					conditions = append(conditions, c.condition())
+				}
+				evaluateAlertRules(conditions)
+			}
+
+			got := []transition{}
+			for _, tr := range takeAlertOutbox() {
+				got = append(got, transition{firing: tr.firing, second: int(tr.at.Sub(testAlertBase) / time.Second)})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("transitions = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// no_reportは最後にコンディションを受け付けたサーバーの時刻から数える
+func TestCheckNoReportAlerts(t *testing.T) {
+	tests := []struct {
+		name string
+		// 見張り始めてから何秒後に受け付けたか 負なら受け付けていない
+		acceptedAfter int
+		// 見張り始めてから何秒後に調べるか
+		checkAfter int
+		wantFiring bool
+	}{
+		{name: "reported recently", acceptedAfter: 50, checkAfter: 100, wantFiring: false},
+		{name: "reported long ago", acceptedAfter: 10, checkAfter: 100, wantFiring: true},
+		{name: "never reported", acceptedAfter: -1, checkAfter: 60, wantFiring: true},
+		{name: "just started watching", acceptedAfter: -1, checkAfter: 59, wantFiring: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &AlertRule{ID: 1, JIAIsuUUID: stringPtr(testAlertIsuUUID), Type: alertRuleTypeNoReport, Duration: 60}
+			resetAlertEngine(t, rule)
+
+			watched := testAlertBase.Add(time.Hour)
+			err := checkNoReportAlerts(watched)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.acceptedAfter >= 0 {
+				// 受け付けた時刻で数え，コンディションの時刻や評価した時刻は使わない
+				condition := testAlertCondition{second: 0}.condition()
+				condition.CreatedAt = watched.Add(time.Duration(tt.acceptedAfter) * time.Second)
+				evaluateAlertRules([]IsuCondition{condition})
+				takeAlertOutbox()
+			}
+
+			err = checkNoReportAlerts(watched.Add(time.Duration(tt.checkAfter) * time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			outbox := takeAlertOutbox()
+			if firing := len(outbox) == 1 && outbox[0].firing; firing != tt.wantFiring {
+				t.Errorf("firing = %v (%+v), want %v", firing, outbox, tt.wantFiring)
+			}
+		})
+	}
+}
+
+// ルールを更新・削除すると発火中のアラートを解決し，積まれた変化を捨てる
+func TestReplaceAlertRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		replace  func(rule *AlertRule) error
+		wantRule bool
+	}{
+		{
+			name: "update",
+			replace: func(rule *AlertRule) error {
+				updated := *rule
+				updated.Type = alertRuleTypeLevelDuration
+				updated.Level = conditionLevelCritical
+				updated.Duration = 60
+				return setAlertRule(&updated)
+			},
+			wantRule: true,
+		},
+		{
+			name:     "delete",
+			replace:  func(rule *AlertRule) error { return removeAlertRule(rule.ID) },
+			wantRule: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved := 0
+			useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+				if !strings.HasPrefix(query, "UPDATE `alert` SET `state` = ?") {
+					return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+				}
+				if args[0] != alertStateResolved || args[2] != int64(1) || args[3] != alertStateFiring {
+					return fakeResult{}, fmt.Errorf("unexpected args: %v", args)
+				}
+				resolved++
+				return fakeResult{affected: 1}, nil
+			})
+
+			rule := &AlertRule{ID: 1, Type: alertRuleTypeConsecutive, Condition: "is_dirty", Count: 1}
+			resetAlertEngine(t, rule)
+			evaluateAlertRules([]IsuCondition{testAlertCondition{second: 1, dirty: true}.condition()})
+
+			err := tt.replace(rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved != 1 {
+				t.Errorf("resolved %d times, want 1", resolved)
+			}
+			if outbox := takeAlertOutbox(); len(outbox) != 0 {
+				t.Errorf("outbox = %+v, want empty", outbox)
+			}
+
+			alertEngine.Lock()
+			_, hasRule := alertEngine.rules[rule.ID]
+			_, hasState := alertEngine.states[alertKey{ruleID: rule.ID, jiaIsuUUID: testAlertIsuUUID}]
+			alertEngine.Unlock()
+			if hasRule != tt.wantRule {
+				t.Errorf("rule exists = %v, want %v", hasRule, tt.wantRule)
+			}
+			if hasState {
+				t.Errorf("state of the replaced rule was kept")
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
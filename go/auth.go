@@ -73,14 +73,14 @@ func postAuthentication(c echo.Context) error {
 		case *jwt.ValidationError:
 			return c.String(http.StatusForbidden, "forbidden")
 		default:
-			// c.Logger().Error(err)
+			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		// c.Logger().Errorf("invalid JWT payload")
+		c.Logger().Errorf("invalid JWT payload")
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	jiaUserIDVar, ok := claims["jia_user_id"]
@@ -102,14 +102,14 @@ func postAuthentication(c echo.Context) error {
 
 	session, err := getSession(c.Request())
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	session.Values["jia_user_id"] = jiaUserID
 	err = session.Save(c.Request(), c.Response())
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -125,20 +125,20 @@ func postSignout(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	session, err := getSession(c.Request())
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	session.Options = &sessions.Options{MaxAge: -1, Path: "/"}
 	err = session.Save(c.Request(), c.Response())
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// サーバーを起動せずにサブコマンドを実行する
+func runCommand(args []string) {
+	var err error
+	mySQLConnectionData = NewMySQLConnectionEnv()
+	storageLocation, err = time.LoadLocation(mySQLConnectionData.Timezone)
+	if err != nil {
+		log.Fatalf("invalid MYSQL_TIMEZONE: %v", err)
+	}
+
+	db, err = mySQLConnectionData.ConnectDB()
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	err = loadConditionConfig()
+	if err != nil {
+		log.Fatalf("failed to load condition config: %v", err)
+	}
+
+	conditionCommitHooks = append(conditionCommitHooks, updateConditionRollups)
+
+	switch args[0] {
+	case "backfill-condition-level":
+		// 保存済みのcondition_levelを現在の判定基準で計算し直す
+		updated, err := backfillConditionLevels()
+		if err != nil {
+			log.Fatalf("failed to backfill condition level: %v", err)
+		}
+		log.Printf("updated condition_level of %d conditions", updated)
+
+		// グラフの集計もcondition_levelの判定基準で計算しているので作り直す
+		rollups, err := backfillConditionRollups()
+		if err != nil {
+			log.Fatalf("failed to backfill condition rollup: %v", err)
+		}
+		log.Printf("rebuilt %d hourly condition rollups", rollups)
+	case "backfill-condition-rollup":
+		// isu_condition_hourlyを全てのコンディションから作り直す
+		rollups, err := backfillConditionRollups()
+		if err != nil {
+			log.Fatalf("failed to backfill condition rollup: %v", err)
+		}
+		log.Printf("rebuilt %d hourly condition rollups", rollups)
+	case "import-conditions":
+		// import-conditions <jia_isu_uuid> <file>
+		// 拡張子が.csvならCSV，それ以外はNDJSONとして過去のコンディションを取り込む
+		if len(args) != 3 {
+			log.Printf("usage: %s import-conditions <jia_isu_uuid> <file>", os.Args[0])
+			os.Exit(2)
+		}
+		err = runImportConditions(args[1], args[2])
+		if err != nil {
+			log.Fatalf("failed to import conditions: %v", err)
+		}
+		// 取り込んだ時間の集計を作り直す
+		processConditionRollups()
+	default:
+		log.Printf("unknown command: %s", args[0])
+		os.Exit(2)
+	}
+}
+
+func runImportConditions(jiaIsuUUID, path string) error {
+	var character sql.NullString
+	err := db.Get(&character, "SELECT `character` FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("not found: isu")
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format := conditionExportFormatNDJSON
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = conditionExportFormatCSV
+	}
+	reader, err := newConditionImportReader(f, format)
+	if err != nil {
+		return err
+	}
+
+	result, err := importConditions(jiaIsuUUID, character.String, reader)
+	b, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(b))
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const compareGraphMaxIsus = 10
+
+type IsuGraphSeries struct {
+	JIAIsuUUID string          `json:"jia_isu_uuid"`
+	Name       string          `json:"name"`
+	Graph      []GraphResponse `json:"graph"`
+}
+
+type CompareGraphResponse struct {
+	Isus []IsuGraphSeries `json:"isus"`
+	// 区間毎にデータのある全てのISUのコンディションをまとめたデータ点
+	FleetAverage []GraphResponse `json:"fleet_average"`
+}
+
+// GET /api/graph/compare
+// 複数のISUのグラフを同じ区間に揃えて取得
+func getCompareGraph(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	uuidCSV := c.QueryParam("jia_isu_uuids")
+	if uuidCSV == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuids")
+	}
+	jiaIsuUUIDs := []string{}
+	seen := map[string]struct{}{}
+	for _, uuid := range strings.Split(uuidCSV, ",") {
+		if _, ok := seen[uuid]; ok || uuid == "" {
+			continue
+		}
+		seen[uuid] = struct{}{}
+		jiaIsuUUIDs = append(jiaIsuUUIDs, uuid)
+	}
+	if len(jiaIsuUUIDs) > compareGraphMaxIsus {
+		return c.String(http.StatusBadRequest, "too many isus")
+	}
+
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return c.String(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: datetime")
+	}
+	window, errMsg := parseGraphWindow(c, time.Unix(datetimeInt64, 0))
+	if errMsg != "" {
+		return c.String(http.StatusBadRequest, errMsg)
+	}
+	precise, ok := parseGraphVersion(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: version")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	query, params, err := sqlx.In(
+		"SELECT `jia_isu_uuid`, `name`, IFNULL(`character`, '') AS `character` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` IN (?)",
+		jiaUserID, jiaIsuUUIDs)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	isuList := []Isu{}
+	err = tx.Select(&isuList, query, params...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(isuList) != len(jiaIsuUUIDs) {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	// ISU毎のグラフと同じく集計済みの時間はisu_condition_hourlyから読む
+	aggregates := map[string]map[int64]*graphAggregate{}
+	for _, isu := range isuList {
+		aggregates[isu.JIAIsuUUID], err = getIsuGraphAggregates(tx, isu.JIAIsuUUID, isu.Character, window)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	res, err := generateCompareGraphResponse(window, isuList, jiaIsuUUIDs, aggregates, precise)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// ISU毎のグラフと平均のグラフを指定された順に並べて生成
+func generateCompareGraphResponse(window graphWindow, isuList []Isu, jiaIsuUUIDs []string,
+	aggregates map[string]map[int64]*graphAggregate, precise bool) (CompareGraphResponse, error) {
+
+	isuByUUID := map[string]Isu{}
+	for _, isu := range isuList {
+		isuByUUID[isu.JIAIsuUUID] = isu
+	}
+
+	res := CompareGraphResponse{Isus: []IsuGraphSeries{}, FleetAverage: []GraphResponse{}}
+	for _, uuid := range jiaIsuUUIDs {
+		res.Isus = append(res.Isus, IsuGraphSeries{
+			JIAIsuUUID: uuid,
+			Name:       isuByUUID[uuid].Name,
+			Graph:      []GraphResponse{},
+		})
+	}
+
+	for i := 0; i+1 < len(window.boundaries); i++ {
+		thisTime, bucketEnd := window.boundaries[i], window.boundaries[i+1]
+
+		bucketAggregates := []*graphAggregate{}
+		for j, uuid := range jiaIsuUUIDs {
+			var data *GraphDataPoint
+			timestamps := []int64{}
+			if a, ok := aggregates[uuid][thisTime.Unix()]; ok && a.count > 0 {
+				d := a.dataPoint(precise)
+				data = &d
+				timestamps = a.timestamps
+				bucketAggregates = append(bucketAggregates, a)
+			}
+
+			res.Isus[j].Graph = append(res.Isus[j].Graph, GraphResponse{
+				StartAt:             thisTime.Unix(),
+				EndAt:               bucketEnd.Unix(),
+				Data:                data,
+				ConditionTimestamps: timestamps,
+			})
+		}
+
+		data, timestamps := fleetGraphDataPoint(bucketAggregates, precise)
+		res.FleetAverage = append(res.FleetAverage, GraphResponse{
+			StartAt:             thisTime.Unix(),
+			EndAt:               bucketEnd.Unix(),
+			Data:                data,
+			ConditionTimestamps: timestamps,
+		})
+	}
+
+	return res, nil
+}
+
+// 区間内の全てのISUのコンディションをまとめて1つのデータ点にする
+// スコア・割合・件数・最小最大・標準偏差はどれも同じコンディションの集まりから計算する
+// 機種によって無い項目の割合は，その項目を持つISUのコンディションの中での割合にする
+func fleetGraphDataPoint(aggregates []*graphAggregate, precise bool) (*GraphDataPoint, []int64) {
+	if len(aggregates) == 0 {
+		return nil, []int64{}
+	}
+
+	// 機種の違うISUも足せるよう項目は空から始める
+	total := newGraphAggregate(ConditionSchema{})
+	keyCounts := map[string]int{}
+	for _, a := range aggregates {
+		total.merge(a)
+		for name := range a.flagCounts {
+			keyCounts[name] += a.count
+		}
+	}
+	// 区間内の時刻は各ISUの集計を繋げただけなので並べ直す
+	sort.Slice(total.timestamps, func(i, j int) bool { return total.timestamps[i] < total.timestamps[j] })
+
+	dataPoint := total.dataPoint(precise)
+	for name, count := range total.flagCounts {
+		dataPoint.Percentage[name] = count * 100 / keyCounts[name]
+		if precise {
+			dataPoint.Precise.Percentage[name] = float64(count) * 100 / float64(keyCounts[name])
+		}
+	}
+	return &dataPoint, total.timestamps
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -23,59 +24,110 @@ type GetIsuConditionResponse struct {
 	Condition      string `json:"condition"`
 	ConditionLevel string `json:"condition_level"`
 	Message        string `json:"message"`
+	// tzが指定された時だけその地域の時刻を付ける
+	Datetime string `json:"datetime,omitempty"`
 }
 
-// ISUのコンディションをDBから取得
+func (r *GetIsuConditionResponse) setLocation(loc *time.Location) {
+	if loc != nil {
+		r.Datetime = time.Unix(r.Timestamp, 0).In(loc).Format(time.RFC3339)
+	}
+}
+
+// tzのIANAの地域名を読む 省略時はnil
+func parseTimezone(c echo.Context) (*time.Location, bool) {
+	tz := c.QueryParam("tz")
+	if tz == "" {
+		return nil, true
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, false
+	}
+	return loc, true
+}
+
+// コンディションの一覧の続きを指す位置
+// 同じtimestampのものはjia_isu_uuidで順序を決める
+type conditionCursor struct {
+	Timestamp  int64  `json:"t"`
+	JIAIsuUUID string `json:"u"`
+}
+
+func (c conditionCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeConditionCursor(s string) (conditionCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return conditionCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+	var c conditionCursor
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return conditionCursor{}, fmt.Errorf("invalid cursor: %v", err)
+	}
+	return c, nil
+}
+
+// ISUのコンディションをDBから取得 startTimeとendTimeはゼロ値なら絞り込まない
+// cursorがあればその続きから取得し，まだ続きがあれば次のcursorを返す
 func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time,
-	limit int, isuName string) ([]*GetIsuConditionResponse, error) {
+	limit int, isuName string, cursor *conditionCursor, ascending bool) ([]*GetIsuConditionResponse, *conditionCursor, error) {
 
 	conditions := []IsuCondition{}
-	var err error
 
 	condLevelKeys := []string{}
 	for key := range conditionLevel {
 		condLevelKeys = append(condLevelKeys, key)
 	}
 
-	if startTime.IsZero() {
-		sql, params, err := sqlx.In(
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND `condition_level` IN (?)"+
-				"	ORDER BY `timestamp` DESC"+
-				" LIMIT ?",
-			jiaIsuUUID, endTime, condLevelKeys, limit)
-		if err != nil {
-			return nil, fmt.Errorf("db error: %v", err)
-		}
+	query := "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?" +
+		"	AND `condition_level` IN (?)"
+	args := []interface{}{jiaIsuUUID, condLevelKeys}
+	if !endTime.IsZero() {
+		query += "	AND `timestamp` < ?"
+		args = append(args, endTime)
+	}
+	if !startTime.IsZero() {
+		query += "	AND ? <= `timestamp`"
+		args = append(args, startTime)
+	}
 
-		err = db.Select(&conditions, sql, params...)
-	} else {
-		sql, params, err := sqlx.In(
-			"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?"+
-				"	AND `timestamp` < ?"+
-				"	AND ? <= `timestamp`"+
-				"	AND `condition_level` IN (?)"+
-				"	ORDER BY `timestamp` DESC"+
-				" LIMIT ?",
-			jiaIsuUUID, endTime, startTime, condLevelKeys, limit)
-		if err != nil {
-			return nil, fmt.Errorf("db error: %v", err)
-		}
+	op, order := "<", "DESC"
+	if ascending {
+		op, order = ">", "ASC"
+	}
+	if cursor != nil {
+		cursorTime := time.Unix(cursor.Timestamp, 0)
+		query += "	AND (`timestamp` " + op + " ? OR (`timestamp` = ? AND `jia_isu_uuid` " + op + " ?))"
+		args = append(args, cursorTime, cursorTime, cursor.JIAIsuUUID)
+	}
+	// 続きがあるか分かるように1件多く取得する
+	query += "	ORDER BY `timestamp` " + order + ", `jia_isu_uuid` " + order +
+		" LIMIT ?"
+	args = append(args, limit+1)
 
-		err = db.Select(&conditions, sql, params...)
+	sql, params, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
 	}
+	err = db.Select(&conditions, sql, params...)
 	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+
+	var next *conditionCursor
+	if len(conditions) > limit {
+		conditions = conditions[:limit]
+		last := conditions[len(conditions)-1]
+		next = &conditionCursor{Timestamp: last.Timestamp.Unix(), JIAIsuUUID: last.JIAIsuUUID}
 	}
 
 	conditionsResponse := []*GetIsuConditionResponse{}
 	for _, c := range conditions {
-		// cLevel, err := calculateConditionLevel(c.Condition)
-		// if err != nil {
-		// 	continue
-		// }
-
 		data := GetIsuConditionResponse{
 			JIAIsuUUID:     c.JIAIsuUUID,
 			IsuName:        isuName,
@@ -89,30 +141,18 @@ func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, c
 
 	}
 
-	// if len(conditionsResponse) > limit {
-	// 	conditionsResponse = conditionsResponse[:limit]
-	// }
-
-	return conditionsResponse, nil
+	return conditionsResponse, next, nil
 }
 
 // ISUのコンディションの文字列からコンディションレベルを計算
-func calculateConditionLevel(condition string) (string, error) {
-	var conditionLevel string
-
-	warnCount := strings.Count(condition, "=true")
-	switch warnCount {
-	case 0:
-		conditionLevel = conditionLevelInfo
-	case 1, 2:
-		conditionLevel = conditionLevelWarning
-	case 3:
-		conditionLevel = conditionLevelCritical
-	default:
-		return "", fmt.Errorf("unexpected warn count")
+func calculateConditionLevel(jiaIsuUUID string, character string, condition string) (string, error) {
+	schema := conditionSchemas.ForIsu(jiaIsuUUID)
+	values, err := schema.Parse(condition)
+	if err != nil {
+		return "", err
 	}
 
-	return conditionLevel, nil
+	return conditionLevelPolicy.Level(schema, character, values), nil
 }
 
 // GET /api/condition/:jia_isu_uuid
@@ -124,7 +164,7 @@ func getIsuConditions(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -157,6 +197,37 @@ func getIsuConditions(c echo.Context) error {
 		startTime = time.Unix(startTimeInt64, 0)
 	}
 
+	limit := conditionLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > conditionMaxLimit {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+
+	var cursor *conditionCursor
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		cur, err := decodeConditionCursor(cursorStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: cursor")
+		}
+		cursor = &cur
+	}
+
+	var ascending bool
+	switch c.QueryParam("order") {
+	case "", "desc":
+	case "asc":
+		ascending = true
+	default:
+		return c.String(http.StatusBadRequest, "bad format: order")
+	}
+
+	loc, ok := parseTimezone(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: tz")
+	}
+
 	var isuName string
 	err = db.Get(&isuName,
 		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
@@ -167,50 +238,29 @@ func getIsuConditions(c echo.Context) error {
 			return c.String(http.StatusNotFound, "not found: isu")
 		}
 
-		//c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	conditionsResponse, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, conditionLimit, isuName)
+	conditionsResponse, next, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, limit, isuName, cursor, ascending)
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	for _, cond := range conditionsResponse {
+		cond.setLocation(loc)
+	}
+	// 続きはこのcursorを付けて同じ条件で取得する
+	if next != nil {
+		c.Response().Header().Set(conditionNextCursorHeader, next.encode())
+	}
 	return c.JSON(http.StatusOK, conditionsResponse)
 }
 
-// ISUのコンディションの文字列がcsv形式になっているか検証
-func isValidConditionFormat(conditionStr string) bool {
-
-	keys := []string{"is_dirty=", "is_overweight=", "is_broken="}
-	const valueTrue = "true"
-	const valueFalse = "false"
-
-	idxCondStr := 0
-
-	for idxKeys, key := range keys {
-		if !strings.HasPrefix(conditionStr[idxCondStr:], key) {
-			return false
-		}
-		idxCondStr += len(key)
-
-		if strings.HasPrefix(conditionStr[idxCondStr:], valueTrue) {
-			idxCondStr += len(valueTrue)
-		} else if strings.HasPrefix(conditionStr[idxCondStr:], valueFalse) {
-			idxCondStr += len(valueFalse)
-		} else {
-			return false
-		}
-
-		if idxKeys < (len(keys) - 1) {
-			if conditionStr[idxCondStr] != ',' {
-				return false
-			}
-			idxCondStr++
-		}
-	}
-
-	return (idxCondStr == len(conditionStr))
+// ISUのコンディションの文字列がそのISUのスキーマのcsv形式になっているか検証
+func isValidConditionFormat(jiaIsuUUID string, conditionStr string) bool {
+	_, err := conditionSchemas.ForIsu(jiaIsuUUID).Parse(conditionStr)
+	return err == nil
 }
 
 type PostIsuConditionRequest struct {
@@ -220,63 +270,59 @@ type PostIsuConditionRequest struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
-var (
-	isuIDValidMap = struct {
-		validMap map[string]int
-		sync.Mutex
-	}{
-		validMap: map[string]int{},
-	}
-)
-
 // POST /api/condition/:jia_isu_uuid
 // ISUからのコンディションを受け取る
 func postIsuCondition(c echo.Context) error {
-	c.NoContent(http.StatusAccepted)
-
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 	if jiaIsuUUID == "" {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
 
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+
 	req := []PostIsuConditionRequest{}
-	err := c.Bind(&req)
+	err = json.Unmarshal(body, &req)
 	if err != nil {
 		return c.String(http.StatusBadRequest, "bad request body")
 	} else if len(req) == 0 {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	// tx, err := db.Beginx()
-	// if err != nil {
-	// 	c.Logger().Errorf("db error: %v", err)
-	// 	return c.NoContent(http.StatusInternalServerError)
-	// }
-	// defer tx.Rollback()
-
-	isuIDValidMap.Lock()
-	if _, ok := isuIDValidMap.validMap[jiaIsuUUID]; !ok {
-		var id int
-		err = db.Get(&id, "SELECT `id` FROM `isu` WHERE `jia_isu_uuid` = ? LIMIT 1", jiaIsuUUID)
-		if err != nil {
-			isuIDValidMap.Unlock()
-			// c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+	auth, err := getIsuConditionAuth(jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
 		}
-		isuIDValidMap.validMap[jiaIsuUUID] = 1
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
-	isuIDValidMap.Unlock()
+	character := auth.character
 
+	// activate時に発行した秘密鍵の署名か，JIAが発行したトークンを検証
+	ok, reason := authenticateCondition(auth, jiaIsuUUID, body,
+		c.Request().Header.Get(isuSignatureHeader), c.Request().Header.Get("Authorization"))
+	if !ok {
+		return c.String(http.StatusUnauthorized, reason)
+	}
+
+	// 全てのコンディションを検証してから受け付ける
+	// 受け付けた時刻はWALにも残し，アラートの評価で使う
+	acceptedAt := time.Now()
+	isuConditions := make([]IsuCondition, 0, len(req))
 	for _, cond := range req {
 		timestamp := time.Unix(cond.Timestamp, 0)
 
-		if !isValidConditionFormat(cond.Condition) {
+		if !isValidConditionFormat(jiaIsuUUID, cond.Condition) {
 			return c.String(http.StatusBadRequest, "bad request body")
 		}
 
-		condLevel, err := calculateConditionLevel(cond.Condition)
+		condLevel, err := calculateConditionLevel(jiaIsuUUID, character, cond.Condition)
 		if err != nil {
-			continue
+			return c.String(http.StatusBadRequest, "bad request body")
 		}
 
 		isuCondition := IsuCondition{
@@ -286,78 +332,68 @@ func postIsuCondition(c echo.Context) error {
 			Condition:      cond.Condition,
 			Message:        cond.Message,
 			ConditionLevel: condLevel,
+			CreatedAt:      acceptedAt,
 		}
 
-		insertDataStore.Lock()
-		insertDataStore.data = append(insertDataStore.data, isuCondition)
-		insertDataStore.Unlock()
+		isuConditions = append(isuConditions, isuCondition)
+	}
 
-		// _, err = tx.Exec(
-		// 	"INSERT INTO `isu_condition`"+
-		// 		"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
-		// 		"	VALUES (?, ?, ?, ?, ?)",
-		// 	jiaIsuUUID, timestamp, cond.IsSitting, cond.Condition, cond.Message)
-		// if err != nil {
-		// 	c.Logger().Errorf("db error: %v", err)
-		// 	return c.NoContent(http.StatusInternalServerError)
-		// }
+	if len(isuConditions) > insertQueue.capacity {
+		return c.String(http.StatusRequestEntityTooLarge, "too many conditions")
+	}
 
+	// 受け付け済みの時刻以前のコンディションは再送とみなして捨て，新しいものだけを受け付ける
+	isuConditions, undoTimestamp := advanceConditionTimestamp(auth, isuConditions)
+	if len(isuConditions) == 0 {
+		return c.String(http.StatusConflict, "replayed condition")
 	}
 
-	// err = tx.Commit()
-	// if err != nil {
-	// 	c.Logger().Errorf("db error: %v", err)
-	// 	return c.NoContent(http.StatusInternalServerError)
-	// }
+	// キューが一杯の時はISUに時間を置いて再送させる
+	if !insertQueue.tryReserve(len(isuConditions)) {
+		undoTimestamp()
+		c.Response().Header().Set("Retry-After", strconv.Itoa(conditionQueueRetryAfter))
+		return c.String(http.StatusServiceUnavailable, "condition queue is full")
+	}
 
-	return nil
-}
+	// 202を返す前にWALへ書き込んでおき，クラッシュしても失われないようにする
+	segmentID, err := conditionLog.Append(isuConditions)
+	if err != nil {
+		undoTimestamp()
+		insertQueue.release(len(isuConditions))
+		c.Logger().Errorf("wal error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-type insertData struct {
-	data []IsuCondition
-	sync.Mutex
-}
+	for _, isuCondition := range isuConditions {
+		insertQueue.ch <- queuedCondition{
+			condition:  isuCondition,
+			walSegment: segmentID,
+		}
+	}
+	conditionFeed.publish(jiaIsuUUID, isuConditions)
 
-var insertDataStore = insertData{
-	data: []IsuCondition{},
+	return c.NoContent(http.StatusAccepted)
 }
 
-func insertConditionTicker() {
-	t := time.NewTicker(insertTickerTime * time.Millisecond) //1秒周期の ticker
-	defer t.Stop()
-
-	for {
-		<-t.C
-
-		if len(insertDataStore.data) == 0 {
-			continue
-		}
-
-		go func() {
-			tx, err := db.Beginx()
-			if err != nil {
-				log.Printf("db error: %v", err)
-				return
+// 前回の終了時にDBへ書き込めなかったコンディションをWALから復元する
+func replayConditionWAL() (int, error) {
+	return conditionLog.Replay(func(conditions []IsuCondition) error {
+		const chunkSize = 1000
+		for start := 0; start < len(conditions); start += chunkSize {
+			end := start + chunkSize
+			if end > len(conditions) {
+				end = len(conditions)
 			}
-			defer tx.Rollback()
-
-			insertDataStore.Lock()
-			defer insertDataStore.Unlock()
 
-			_, err = tx.NamedExec(
-				"INSERT INTO `isu_condition`"+
-					"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `condition_level`)"+
-					"	VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message, :condition_level)",
-				insertDataStore.data)
-
-			err = tx.Commit()
-			if err != nil {
-				log.Printf("db error: %v", err)
-				return
+			batch := make([]queuedCondition, 0, end-start)
+			for _, condition := range conditions[start:end] {
+				batch = append(batch, queuedCondition{condition: condition})
 			}
-
-			insertDataStore.data = []IsuCondition{}
-			return
-		}()
-	}
+			_, requeue := insertConditionBatch(batch)
+			if len(requeue) > 0 {
+				return fmt.Errorf("db error: failed to replay %d conditions", len(requeue))
+			}
+		}
+		return nil
+	})
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursor  string
+		want    conditionCursor
+		wantErr bool
+	}{
+		{
+			name:   "round trip",
+			cursor: conditionCursor{Timestamp: 1627776000, JIAIsuUUID: "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"}.encode(),
+			want:   conditionCursor{Timestamp: 1627776000, JIAIsuUUID: "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"},
+		},
+		{name: "not base64", cursor: "!!!", wantErr: true},
+		{name: "not json", cursor: "bm90IGpzb24", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeConditionCursor(tt.cursor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeConditionCursor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("decodeConditionCursor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// isu_conditionに対するgetIsuConditionsFromDBのクエリを手元のコンディションで評価する
+func conditionPageHandler(conditions []IsuCondition) fakeDBHandler {
+	return func(query string, args []driver.Value) (fakeResult, error) {
+		if !strings.HasPrefix(query, "SELECT * FROM `isu_condition`") {
+			return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+		}
+
+		jiaIsuUUID := args[0].(string)
+		inList := query[strings.Index(query, "`condition_level` IN ("):]
+		levelCount := strings.Count(inList[:strings.Index(inList, ")")], "?")
+		levels := map[string]struct{}{}
+		for _, level := range args[1 : 1+levelCount] {
+			levels[level.(string)] = struct{}{}
+		}
+		args = args[1+levelCount:]
+
+		var endTime, startTime, cursorTime time.Time
+		var cursorUUID string
+		if strings.Contains(query, "AND `timestamp` < ?") {
+			endTime, args = args[0].(time.Time), args[1:]
+		}
+		if strings.Contains(query, "AND ? <= `timestamp`") {
+			startTime, args = args[0].(time.Time), args[1:]
+		}
+		hasCursor := strings.Contains(query, "AND (`timestamp`")
+		if hasCursor {
+			cursorTime, cursorUUID, args = args[0].(time.Time), args[2].(string), args[3:]
+		}
+		limit := int(args[0].(int64))
+		ascending := strings.Contains(query, "ORDER BY `timestamp` ASC")
+
+		after := func(c IsuCondition) bool {
+			if ascending {
+				return c.Timestamp.After(cursorTime) || (c.Timestamp.Equal(cursorTime) && c.JIAIsuUUID > cursorUUID)
+			}
+			return c.Timestamp.Before(cursorTime) || (c.Timestamp.Equal(cursorTime) && c.JIAIsuUUID < cursorUUID)
+		}
+
+		matched := []IsuCondition{}
+		for _, c := range conditions {
+			if _, ok := levels[c.ConditionLevel]; !ok || c.JIAIsuUUID != jiaIsuUUID {
+				continue
+			}
+			if !endTime.IsZero() && !c.Timestamp.Before(endTime) {
+				continue
+			}
+			if !startTime.IsZero() && c.Timestamp.Before(startTime) {
+				continue
+			}
+			if hasCursor && !after(c) {
+				continue
+			}
+			matched = append(matched, c)
+		}
+		sort.Slice(matched, func(i, j int) bool {
+			if ascending {
+				return matched[i].Timestamp.Before(matched[j].Timestamp)
+			}
+			return matched[i].Timestamp.After(matched[j].Timestamp)
+		})
+		if len(matched) > limit {
+			matched = matched[:limit]
+		}
+		return fakeResult{columns: isuConditionColumns, rows: isuConditionRows(matched)}, nil
+	}
+}
+
+// 次のcursorを辿ると，条件に合うコンディションを重複も抜けも無く一度ずつ取得できる
+func TestGetIsuConditionsFromDBPagination(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+	base := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	levels := []string{conditionLevelInfo, conditionLevelWarning, conditionLevelCritical, conditionLevelInfo,
+		conditionLevelWarning, conditionLevelInfo, conditionLevelCritical}
+	conditions := []IsuCondition{}
+	for i, level := range levels {
+		conditions = append(conditions, IsuCondition{
+			JIAIsuUUID:     jiaIsuUUID,
+			Timestamp:      base.Add(time.Duration(i) * time.Minute),
+			ConditionLevel: level,
+		})
+	}
+	// 他のISUのコンディションは含まれない
+	conditions = append(conditions, IsuCondition{JIAIsuUUID: "other", Timestamp: base, ConditionLevel: conditionLevelInfo})
+	useFakeDB(t, conditionPageHandler(conditions))
+
+	all := map[string]interface{}{conditionLevelInfo: struct{}{}, conditionLevelWarning: struct{}{}, conditionLevelCritical: struct{}{}}
+	tests := []struct {
+		name           string
+		conditionLevel map[string]interface{}
+		startTime      time.Time
+		endTime        time.Time
+		limit          int
+		ascending      bool
+		// 取得されるコンディションのbaseからの分
+		want      []int
+		wantPages int
+	}{
+		{name: "descending", conditionLevel: all, endTime: base.Add(time.Hour), limit: 3, want: []int{6, 5, 4, 3, 2, 1, 0}, wantPages: 3},
+		{name: "ascending", conditionLevel: all, limit: 2, ascending: true, want: []int{0, 1, 2, 3, 4, 5, 6}, wantPages: 4},
+		{name: "exact pages", conditionLevel: all, endTime: base.Add(time.Hour), limit: 7, want: []int{6, 5, 4, 3, 2, 1, 0}, wantPages: 1},
+		{name: "level filter", conditionLevel: map[string]interface{}{conditionLevelInfo: struct{}{}}, endTime: base.Add(time.Hour), limit: 2, want: []int{5, 3, 0}, wantPages: 2},
+		{name: "time range", conditionLevel: all, startTime: base.Add(2 * time.Minute), endTime: base.Add(5 * time.Minute), limit: 2, want: []int{4, 3, 2}, wantPages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []int{}
+			pages := 0
+			var cursor *conditionCursor
+			for {
+				res, next, err := getIsuConditionsFromDB(db, jiaIsuUUID, tt.endTime, tt.conditionLevel, tt.startTime,
+					tt.limit, "isu", cursor, tt.ascending)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages++
+				for _, r := range res {
+					got = append(got, int(time.Unix(r.Timestamp, 0).Sub(base)/time.Minute))
+				}
+				if next == nil {
+					break
+				}
+				if pages > len(conditions) {
+					t.Fatal("cursor does not advance")
+				}
+				c, err := decodeConditionCursor(next.encode())
+				if err != nil {
+					t.Fatal(err)
+				}
+				cursor = &c
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("conditions = %v, want %v", got, tt.want)
+			}
+			if pages != tt.wantPages {
+				t.Errorf("pages = %d, want %d", pages, tt.wantPages)
+			}
+		})
+	}
+}
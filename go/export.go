@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	conditionExportChunkSize = 1000
+
+	conditionExportFormatCSV    = "csv"
+	conditionExportFormatNDJSON = "ndjson"
+
+	mimeTextCSV           = "text/csv"
+	mimeApplicationNDJSON = "application/x-ndjson"
+)
+
+var conditionExportCSVHeader = []string{
+	"jia_isu_uuid", "isu_name", "timestamp", "is_sitting", "condition", "condition_level", "message",
+}
+
+// formatが無ければAcceptから出力形式を決める
+func conditionExportFormat(c echo.Context) (string, bool) {
+	switch format := c.QueryParam("format"); format {
+	case conditionExportFormatCSV, conditionExportFormatNDJSON:
+		return format, true
+	case "":
+	default:
+		return "", false
+	}
+
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	if strings.Contains(accept, mimeApplicationNDJSON) {
+		return conditionExportFormatNDJSON, true
+	}
+	return conditionExportFormatCSV, true
+}
+
+// GET /api/condition/:jia_isu_uuid/export
+// ISUの期間内の全てのコンディションをCSVかNDJSONで出力
+// 行数が多くてもメモリを使わないよう，古い順に少しずつDBから読んで書き出す
+func getIsuConditionsExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+
+	format, ok := conditionExportFormat(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: format")
+	}
+
+	loc, ok := parseTimezone(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: tz")
+	}
+
+	var startTime, endTime time.Time
+	if startTimeStr := c.QueryParam("start_time"); startTimeStr != "" {
+		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: start_time")
+		}
+		startTime = time.Unix(startTimeInt64, 0)
+	}
+	if endTimeStr := c.QueryParam("end_time"); endTimeStr != "" {
+		endTimeInt64, err := strconv.ParseInt(endTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: end_time")
+		}
+		endTime = time.Unix(endTimeInt64, 0)
+	}
+
+	conditionLevel := map[string]interface{}{
+		conditionLevelInfo:     struct{}{},
+		conditionLevelWarning:  struct{}{},
+		conditionLevelCritical: struct{}{},
+	}
+	if conditionLevelCSV := c.QueryParam("condition_level"); conditionLevelCSV != "" {
+		conditionLevel = map[string]interface{}{}
+		for _, level := range strings.Split(conditionLevelCSV, ",") {
+			conditionLevel[level] = struct{}{}
+		}
+	}
+
+	var isuName string
+	err = db.Get(&isuName,
+		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaIsuUUID, jiaUserID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := c.Response()
+	if format == conditionExportFormatNDJSON {
+		res.Header().Set(echo.HeaderContentType, mimeApplicationNDJSON)
+	} else {
+		res.Header().Set(echo.HeaderContentType, mimeTextCSV+"; charset=utf-8")
+	}
+	res.Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+jiaIsuUUID+"."+format+"\"")
+	res.WriteHeader(http.StatusOK)
+
+	csvWriter := csv.NewWriter(res)
+	jsonEncoder := json.NewEncoder(res)
+	if format == conditionExportFormatCSV {
+		header := conditionExportCSVHeader
+		if loc != nil {
+			header = append(header[:len(header):len(header)], "datetime")
+		}
+		csvWriter.Write(header)
+	}
+
+	// ヘッダーを送った後は途中で失敗してもステータスを変えられないので打ち切るだけにする
+	var cursor *conditionCursor
+	for {
+		if c.Request().Context().Err() != nil {
+			return nil
+		}
+
+		conditions, next, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime,
+			conditionExportChunkSize, isuName, cursor, true)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return nil
+		}
+
+		for _, cond := range conditions {
+			cond.setLocation(loc)
+			if format == conditionExportFormatNDJSON {
+				err = jsonEncoder.Encode(cond)
+			} else {
+				record := []string{
+					cond.JIAIsuUUID,
+					cond.IsuName,
+					strconv.FormatInt(cond.Timestamp, 10),
+					strconv.FormatBool(cond.IsSitting),
+					cond.Condition,
+					cond.ConditionLevel,
+					cond.Message,
+				}
+				if loc != nil {
+					record = append(record, cond.Datetime)
+				}
+				err = csvWriter.Write(record)
+			}
+			if err != nil {
+				return nil
+			}
+		}
+		csvWriter.Flush()
+		if csvWriter.Error() != nil {
+			return nil
+		}
+		res.Flush()
+
+		if next == nil {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	conditionFeedQueueSize    = 64
+	conditionFeedWriteTimeout = 10 * time.Second
+)
+
+// 受け付けたコンディションをISU毎の購読者に配信する
+type conditionFeedSubscriber struct {
+	ch             chan IsuCondition
+	conditionLevel map[string]interface{}
+}
+
+type conditionFeedHub struct {
+	subscribers map[string]map[*conditionFeedSubscriber]struct{}
+	closed      bool
+	sync.Mutex
+}
+
+var conditionFeed = &conditionFeedHub{
+	subscribers: map[string]map[*conditionFeedSubscriber]struct{}{},
+}
+
+func (h *conditionFeedHub) subscribe(jiaIsuUUID string, conditionLevel map[string]interface{}) *conditionFeedSubscriber {
+	h.Lock()
+	defer h.Unlock()
+
+	s := &conditionFeedSubscriber{
+		ch:             make(chan IsuCondition, conditionFeedQueueSize),
+		conditionLevel: conditionLevel,
+	}
+	if h.closed {
+		close(s.ch)
+		return s
+	}
+	if h.subscribers[jiaIsuUUID] == nil {
+		h.subscribers[jiaIsuUUID] = map[*conditionFeedSubscriber]struct{}{}
+	}
+	h.subscribers[jiaIsuUUID][s] = struct{}{}
+	return s
+}
+
+func (h *conditionFeedHub) unsubscribe(jiaIsuUUID string, s *conditionFeedSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.remove(jiaIsuUUID, s)
+}
+
+// ロックを取った状態で呼ぶ
+func (h *conditionFeedHub) remove(jiaIsuUUID string, s *conditionFeedSubscriber) {
+	subscribers, ok := h.subscribers[jiaIsuUUID]
+	if !ok {
+		return
+	}
+	if _, ok := subscribers[s]; !ok {
+		return
+	}
+	delete(subscribers, s)
+	if len(subscribers) == 0 {
+		delete(h.subscribers, jiaIsuUUID)
+	}
+	close(s.ch)
+}
+
+func (h *conditionFeedHub) publish(jiaIsuUUID string, conditions []IsuCondition) {
+	h.Lock()
+	defer h.Unlock()
+
+	for s := range h.subscribers[jiaIsuUUID] {
+		for _, condition := range conditions {
+			if _, ok := s.conditionLevel[condition.ConditionLevel]; !ok {
+				continue
+			}
+			select {
+			case s.ch <- condition:
+			default:
+				// 追いつけない購読者は切断して再接続させる
+				h.remove(jiaIsuUUID, s)
+			}
+			if _, ok := h.subscribers[jiaIsuUUID][s]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// 全ての購読を終わらせる サーバーの終了時に呼ぶ
+func (h *conditionFeedHub) closeAll() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.closed = true
+	for jiaIsuUUID, subscribers := range h.subscribers {
+		for s := range subscribers {
+			h.remove(jiaIsuUUID, s)
+		}
+	}
+}
+
+// 別サイトのページからセッションを使って接続されないよう，Originがあればホストと一致するか確かめる
+func checkConditionFeedOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host != req.Host {
+		return fmt.Errorf("bad origin: %s", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+// GET /api/condition/:jia_isu_uuid/feed
+// ISUのコンディションを受け付けたそばからWebSocketで配信
+func getIsuConditionFeed(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+
+	conditionLevelCSV := c.QueryParam("condition_level")
+	if conditionLevelCSV == "" {
+		return c.String(http.StatusBadRequest, "missing: condition_level")
+	}
+	conditionLevel := map[string]interface{}{}
+	for _, level := range strings.Split(conditionLevelCSV, ",") {
+		conditionLevel[level] = struct{}{}
+	}
+
+	loc, ok := parseTimezone(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: tz")
+	}
+
+	var isuName string
+	err = db.Get(&isuName,
+		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaIsuUUID, jiaUserID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	server := websocket.Server{
+		Handshake: checkConditionFeedOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			s := conditionFeed.subscribe(jiaIsuUUID, conditionLevel)
+			defer conditionFeed.unsubscribe(jiaIsuUUID, s)
+
+			// クライアントからは何も受け取らないが，切断を検知するために読み続ける
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var msg string
+				for websocket.Message.Receive(ws, &msg) == nil {
+				}
+			}()
+
+			for {
+				select {
+				case <-closed:
+					return
+				case condition, ok := <-s.ch:
+					if !ok {
+						return
+					}
+					res := GetIsuConditionResponse{
+						JIAIsuUUID:     condition.JIAIsuUUID,
+						IsuName:        isuName,
+						Timestamp:      condition.Timestamp.Unix(),
+						IsSitting:      condition.IsSitting,
+						Condition:      condition.Condition,
+						ConditionLevel: condition.ConditionLevel,
+						Message:        condition.Message,
+					}
+					res.setLocation(loc)
+					ws.SetWriteDeadline(time.Now().Add(conditionFeedWriteTimeout))
+					err := websocket.JSON.Send(ws, res)
+					if err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	conditionImportChunkSize = 1000
+	// これを超えた分のエラーは件数だけ返す
+	conditionImportMaxErrors = 1000
+	conditionImportMaxLine   = 1 << 20
+)
+
+type ConditionImportError struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type ConditionImportResult struct {
+	Imported   int                    `json:"imported"`
+	Duplicated int                    `json:"duplicated"`
+	ErrorCount int                    `json:"error_count"`
+	Errors     []ConditionImportError `json:"errors"`
+}
+
+func (r *ConditionImportResult) addError(line int, reason string) {
+	r.ErrorCount++
+	if len(r.Errors) < conditionImportMaxErrors {
+		r.Errors = append(r.Errors, ConditionImportError{Line: line, Reason: reason})
+	}
+}
+
+// ファイルから1行ずつPostIsuConditionRequestを読む
+// 行の内容が不正な時はrowErrを，読み込み自体に失敗した時はerrを返す
+type conditionImportReader interface {
+	next() (line int, req PostIsuConditionRequest, rowErr error, err error)
+}
+
+type ndjsonConditionReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONConditionReader(r io.Reader) *ndjsonConditionReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), conditionImportMaxLine)
+	return &ndjsonConditionReader{scanner: scanner}
+}
+
+func (r *ndjsonConditionReader) next() (int, PostIsuConditionRequest, error, error) {
+	for r.scanner.Scan() {
+		r.line++
+		b := r.scanner.Bytes()
+		if len(strings.TrimSpace(string(b))) == 0 {
+			continue
+		}
+		var req PostIsuConditionRequest
+		err := json.Unmarshal(b, &req)
+		if err != nil {
+			return r.line, PostIsuConditionRequest{}, fmt.Errorf("bad json: %v", err), nil
+		}
+		return r.line, req, nil, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return r.line, PostIsuConditionRequest{}, nil, err
+	}
+	return r.line, PostIsuConditionRequest{}, nil, io.EOF
+}
+
+// 1行目のヘッダーで列を決める 知らない列は無視する
+type csvConditionReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	// ヘッダーを1行目とした行番号 値に改行を含むレコードも1行と数える
+	line int
+}
+
+func newCSVConditionReader(r io.Reader) (*csvConditionReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %v", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"is_sitting", "condition", "message", "timestamp"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing csv column: %s", name)
+		}
+	}
+	return &csvConditionReader{reader: reader, columns: columns, line: 1}, nil
+}
+
+func (r *csvConditionReader) next() (int, PostIsuConditionRequest, error, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			r.line++
+			return r.line, PostIsuConditionRequest{}, fmt.Errorf("bad csv: %v", parseErr.Err), nil
+		}
+		return r.line, PostIsuConditionRequest{}, nil, err
+	}
+	r.line++
+	line := r.line
+
+	field := func(name string) (string, bool) {
+		i := r.columns[name]
+		if i >= len(record) {
+			return "", false
+		}
+		return record[i], true
+	}
+
+	var req PostIsuConditionRequest
+	isSitting, ok := field("is_sitting")
+	if !ok {
+		return line, req, fmt.Errorf("missing: is_sitting"), nil
+	}
+	req.IsSitting, err = strconv.ParseBool(isSitting)
+	if err != nil {
+		return line, req, fmt.Errorf("bad format: is_sitting"), nil
+	}
+	timestamp, ok := field("timestamp")
+	if !ok {
+		return line, req, fmt.Errorf("missing: timestamp"), nil
+	}
+	req.Timestamp, err = strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return line, req, fmt.Errorf("bad format: timestamp"), nil
+	}
+	if req.Condition, ok = field("condition"); !ok {
+		return line, req, fmt.Errorf("missing: condition"), nil
+	}
+	if req.Message, ok = field("message"); !ok {
+		return line, req, fmt.Errorf("missing: message"), nil
+	}
+	return line, req, nil, nil
+}
+
+func newConditionImportReader(r io.Reader, format string) (conditionImportReader, error) {
+	if format == conditionExportFormatCSV {
+		return newCSVConditionReader(r)
+	}
+	return newNDJSONConditionReader(r), nil
+}
+
+type importedCondition struct {
+	line      int
+	condition IsuCondition
+}
+
+// ファイルのコンディションを検証してisu_conditionに書き込む
+// 同じ(jia_isu_uuid, timestamp)が既にあるものは書き込まずに数える
+func importConditions(jiaIsuUUID, character string, reader conditionImportReader) (ConditionImportResult, error) {
+	result := ConditionImportResult{Errors: []ConditionImportError{}}
+
+	chunk := []importedCondition{}
+	for {
+		line, req, rowErr, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if rowErr != nil {
+			result.addError(line, rowErr.Error())
+			continue
+		}
+
+		if !isValidConditionFormat(jiaIsuUUID, req.Condition) {
+			result.addError(line, "bad format: condition")
+			continue
+		}
+		condLevel, err := calculateConditionLevel(jiaIsuUUID, character, req.Condition)
+		if err != nil {
+			result.addError(line, err.Error())
+			continue
+		}
+
+		chunk = append(chunk, importedCondition{
+			line: line,
+			condition: IsuCondition{
+				JIAIsuUUID:     jiaIsuUUID,
+				Timestamp:      time.Unix(req.Timestamp, 0),
+				IsSitting:      req.IsSitting,
+				Condition:      req.Condition,
+				Message:        req.Message,
+				ConditionLevel: condLevel,
+			},
+		})
+		if len(chunk) >= conditionImportChunkSize {
+			err := flushImportedConditions(chunk, &result)
+			if err != nil {
+				return result, err
+			}
+			chunk = []importedCondition{}
+		}
+	}
+
+	err := flushImportedConditions(chunk, &result)
+	return result, err
+}
+
+// 書き込み済みのものはDBで，チャンク内の重複はここで取り除く
+// 前のチャンクは書き込み済みなのでチャンクを跨いだ重複もDBで見つかる
+func flushImportedConditions(chunk []importedCondition, result *ConditionImportResult) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+
+	timestamps := make([]time.Time, 0, len(chunk))
+	for _, ic := range chunk {
+		timestamps = append(timestamps, ic.condition.Timestamp)
+	}
+	query, params, err := sqlx.In(
+		"SELECT `timestamp` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` IN (?)",
+		chunk[0].condition.JIAIsuUUID, timestamps)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	existing := []time.Time{}
+	err = db.Select(&existing, query, params...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	seen := map[int64]struct{}{}
+	for _, t := range existing {
+		seen[t.Unix()] = struct{}{}
+	}
+	// dead letterに移したものを行番号で報告するため，時刻から行を引けるようにする
+	lines := map[int64]int{}
+	batch := make([]queuedCondition, 0, len(chunk))
+	for _, ic := range chunk {
+		key := ic.condition.Timestamp.Unix()
+		if _, ok := seen[key]; ok {
+			result.Duplicated++
+			continue
+		}
+		seen[key] = struct{}{}
+		lines[key] = ic.line
+		batch = append(batch, queuedCondition{condition: ic.condition})
+	}
+
+	// 過去のコンディションなのでアラートは評価しない
+	inserted := insertConditionsWithRetry(batch, false)
+	result.Imported += inserted.inserted
+	// 確認してから書き込むまでの間に他の経路で書き込まれたもの
+	result.Duplicated += len(inserted.done) - len(inserted.deadLettered) - inserted.inserted
+	for _, dl := range inserted.deadLettered {
+		result.addError(lines[dl.queued.condition.Timestamp.Unix()], dl.reason.Error())
+	}
+	if len(inserted.requeue) > 0 {
+		return fmt.Errorf("db error: failed to write %d conditions", len(inserted.requeue))
+	}
+	return nil
+}
+
+// formatが無ければContent-Typeから入力形式を決める
+func conditionImportFormat(c echo.Context) (string, bool) {
+	switch format := c.QueryParam("format"); format {
+	case conditionExportFormatCSV, conditionExportFormatNDJSON:
+		return format, true
+	case "":
+	default:
+		return "", false
+	}
+
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), mimeTextCSV) {
+		return conditionExportFormatCSV, true
+	}
+	return conditionExportFormatNDJSON, true
+}
+
+// POST /api/condition/:jia_isu_uuid/import
+// 他のシステムから移行するISUの過去のコンディションをCSVかNDJSONで取り込む
+func postIsuConditionsImport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+
+	format, ok := conditionImportFormat(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: format")
+	}
+
+	var character sql.NullString
+	err = db.Get(&character,
+		"SELECT `character` FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
+		jiaIsuUUID, jiaUserID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	reader, err := newConditionImportReader(c.Request().Body, format)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	result, err := importConditions(jiaIsuUUID, character.String, reader)
+	if err != nil {
+		c.Logger().Errorf("failed to import conditions: %v", err)
+		return c.JSON(http.StatusInternalServerError, result)
+	}
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionImportReader(t *testing.T) {
+	type row struct {
+		line   int
+		req    PostIsuConditionRequest
+		rowErr bool
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		want    []row
+		wantErr bool
+	}{
+		{
+			name:   "ndjson",
+			format: conditionExportFormatNDJSON,
+			input: `{"is_sitting":true,"condition":"c","message":"m","timestamp":100}` + "\n\n" +
+				`{"is_sitting":` + "\n" +
+				`{"is_sitting":false,"condition":"c","message":"m","timestamp":101}` + "\n",
+			want: []row{
+				{line: 1, req: PostIsuConditionRequest{IsSitting: true, Condition: "c", Message: "m", Timestamp: 100}},
+				{line: 3, rowErr: true},
+				{line: 4, req: PostIsuConditionRequest{IsSitting: false, Condition: "c", Message: "m", Timestamp: 101}},
+			},
+		},
+		{
+			name:   "csv",
+			format: conditionExportFormatCSV,
+			input: "timestamp,is_sitting,condition,message,extra\n" +
+				"100,true,c,\"multi\nline\",x\n" +
+				"x,true,c,m,x\n" +
+				"101,false,c\n",
+			want: []row{
+				{line: 2, req: PostIsuConditionRequest{IsSitting: true, Condition: "c", Message: "multi\nline", Timestamp: 100}},
+				{line: 3, rowErr: true},
+				{line: 4, rowErr: true},
+			},
+		},
+		{
+			name:    "csv without column",
+			format:  conditionExportFormatCSV,
+			input:   "timestamp,is_sitting,condition\n100,true,c\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := newConditionImportReader(strings.NewReader(tt.input), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newConditionImportReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got := []row{}
+			for {
+				line, req, rowErr, err := reader.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rowErr != nil {
+					got = append(got, row{line: line, rowErr: true})
+					continue
+				}
+				got = append(got, row{line: line, req: req})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ファイル内の重複とDBに既にあるものは書き込まずに数える
+func TestImportConditionsDeduplicates(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+	const condition = "is_dirty=false,is_overweight=false,is_broken=false"
+
+	tests := []struct {
+		name           string
+		existing       []int64
+		timestamps     []int64
+		wantImported   int
+		wantDuplicated int
+		wantWritten    []int64
+	}{
+		{name: "new", timestamps: []int64{100, 101}, wantImported: 2, wantWritten: []int64{100, 101}},
+		{name: "duplicated in file", timestamps: []int64{100, 101, 100}, wantImported: 2, wantDuplicated: 1, wantWritten: []int64{100, 101}},
+		{name: "already in db", existing: []int64{100}, timestamps: []int64{100, 101}, wantImported: 1, wantDuplicated: 1, wantWritten: []int64{101}},
+		{name: "all in db", existing: []int64{100, 101}, timestamps: []int64{101, 100}, wantImported: 0, wantDuplicated: 2, wantWritten: []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := map[int64]struct{}{}
+			for _, ts := range tt.existing {
+				stored[ts] = struct{}{}
+			}
+			written := []int64{}
+			useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+				switch {
+				case strings.HasPrefix(query, "SELECT `timestamp` FROM `isu_condition`"):
+					res := fakeResult{columns: []string{"timestamp"}}
+					for _, arg := range args[1:] {
+						if _, ok := stored[arg.(time.Time).Unix()]; ok {
+							res.rows = append(res.rows, []driver.Value{arg})
+						}
+					}
+					return res, nil
+				case strings.HasPrefix(query, "INSERT INTO `isu_condition`"):
+					var affected int64
+					for i := 0; i+5 < len(args); i += 6 {
+						ts := args[i+1].(time.Time).Unix()
+						if _, ok := stored[ts]; ok {
+							continue
+						}
+						stored[ts] = struct{}{}
+						written = append(written, ts)
+						affected++
+					}
+					return fakeResult{affected: affected}, nil
+				}
+				return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+			})
+			hooks := conditionCommitHooks
+			conditionCommitHooks = nil
+			defer func() { conditionCommitHooks = hooks }()
+
+			input := ""
+			for _, ts := range tt.timestamps {
+				input += fmt.Sprintf(`{"is_sitting":true,"condition":%q,"message":"m","timestamp":%d}`+"\n", condition, ts)
+			}
+			result, err := importConditions(jiaIsuUUID, "いじっぱり", newNDJSONConditionReader(strings.NewReader(input)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Imported != tt.wantImported || result.Duplicated != tt.wantDuplicated || result.ErrorCount != 0 {
+				t.Errorf("result = %+v, want imported %d duplicated %d", result, tt.wantImported, tt.wantDuplicated)
+			}
+			if !reflect.DeepEqual(written, tt.wantWritten) {
+				t.Errorf("written = %v, want %v", written, tt.wantWritten)
+			}
+		})
+	}
+}
@@ -30,7 +30,36 @@ func postInitialize(c echo.Context) error {
 	cmd.Stdout = os.Stderr
 	err = cmd.Run()
 	if err != nil {
-		// c.Logger().Errorf("exec init.sh error: %v", err)
+		c.Logger().Errorf("exec init.sh error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 初期データのcondition_levelはデフォルトのスキーマと判定基準で計算されている
+	if !isPatchConditionLevelConfig() {
+		_, err = backfillConditionLevels()
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	// 集計は時間がかかるのでconditionRollupWorkerに任せ，終わるまでグラフはisu_conditionから読む
+	requestConditionRollupBackfill()
+
+	isuIDValidMap.Lock()
+	isuIDValidMap.validMap = map[string]*isuConditionAuth{}
+	isuIDValidMap.Unlock()
+
+	err = loadAlertRules()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	resetTrend()
+	err = reconcileTrend(c.Request().Context())
+	if err != nil {
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -40,7 +69,7 @@ func postInitialize(c echo.Context) error {
 		request.JIAServiceURL,
 	)
 	if err != nil {
-		// c.Logger().Errorf("db error : %v", err)
+		c.Logger().Errorf("db error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	mysqlErrNumTooManyConnections = 1040
+	mysqlErrNumLockWaitTimeout    = 1205
+	mysqlErrNumDeadlock           = 1213
+
+	insertMaxAttempts    = 4
+	insertBackoffInitial = 50 * time.Millisecond
+	insertBackoffMax     = 1 * time.Second
+)
+
+// isu_conditionへの書き込み結果の件数
+type conditionInsertStats struct {
+	Inserted     int64
+	Retried      int64
+	Deduplicated int64
+	Dropped      int64
+}
+
+var conditionInsertCounter conditionInsertStats
+
+// isu_conditionへの書き込みがコミットされた後に呼ばれる処理
+var conditionCommitHooks []func([]IsuCondition)
+
+// ISUから届いたコンディションの時だけ呼ばれる処理
+// 取り込んだ過去のコンディションでアラートを発火させないよう分けている
+var liveConditionCommitHooks []func([]IsuCondition)
+
+// dead letterに移したコンディションと理由
+type deadLetteredCondition struct {
+	queued queuedCondition
+	reason error
+}
+
+// insertConditionsWithRetryの結果
+type conditionInsertResult struct {
+	// 書き込み済み・既にDBにあった・dead letterに移したもの
+	done []queuedCondition
+	// 再試行しても書き込めなかったもの
+	requeue []queuedCondition
+	// 実際にisu_conditionに書き込んだ件数
+	inserted int
+	// doneのうちdead letterに移したもの
+	deadLettered []deadLetteredCondition
+}
+
+func (r *conditionInsertResult) merge(o conditionInsertResult) {
+	r.done = append(r.done, o.done...)
+	r.requeue = append(r.requeue, o.requeue...)
+	r.inserted += o.inserted
+	r.deadLettered = append(r.deadLettered, o.deadLettered...)
+}
+
+// 時間を置けば成功する見込みのあるエラーか
+// 接続断とMySQLの一時的なエラーだけを再試行し，それ以外は何度書いても失敗するものとしてdead letterに移す
+func isTransientDBError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlErrNumTooManyConnections, mysqlErrNumLockWaitTimeout, mysqlErrNumDeadlock:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// コンディションをまとめてisu_conditionに書き込む
+// 書き込み済み・重複・dead letterに移したものをdoneとして，
+// 再試行しても書き込めなかったものをrequeueとして返す
+func insertConditionBatch(batch []queuedCondition) (done []queuedCondition, requeue []queuedCondition) {
+	seen := map[string]struct{}{}
+	unique := make([]queuedCondition, 0, len(batch))
+	for _, q := range batch {
+		key := q.condition.JIAIsuUUID + "/" + strconv.FormatInt(q.condition.Timestamp.Unix(), 10)
+		if _, ok := seen[key]; ok {
+			// 同じ(jia_isu_uuid, timestamp)は先に受け取ったものを残す
+			atomic.AddInt64(&conditionInsertCounter.Deduplicated, 1)
+			done = append(done, q)
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, q)
+	}
+
+	result := insertConditionsWithRetry(unique, true)
+	return append(done, result.done...), result.requeue
+}
+
+// liveがfalseの時は取り込んだ過去のコンディションとしてliveConditionCommitHooksを呼ばない
+func insertConditionsWithRetry(batch []queuedCondition, live bool) conditionInsertResult {
+	if len(batch) == 0 {
+		return conditionInsertResult{}
+	}
+
+	conditions := make([]IsuCondition, 0, len(batch))
+	for _, q := range batch {
+		conditions = append(conditions, q.condition)
+	}
+
+	backoff := insertBackoffInitial
+	var err error
+	for attempt := 1; attempt <= insertMaxAttempts; attempt++ {
+		var inserted int64
+		inserted, err = insertConditions(conditions)
+		if err == nil {
+			// 既にDBにあったものは書き込まれていないので重複として数える
+			atomic.AddInt64(&conditionInsertCounter.Inserted, inserted)
+			atomic.AddInt64(&conditionInsertCounter.Deduplicated, int64(len(batch))-inserted)
+			for _, hook := range conditionCommitHooks {
+				hook(conditions)
+			}
+			if live {
+				for _, hook := range liveConditionCommitHooks {
+					hook(conditions)
+				}
+			}
+			return conditionInsertResult{done: batch, inserted: int(inserted)}
+		}
+		if !isTransientDBError(err) {
+			break
+		}
+		if attempt == insertMaxAttempts {
+			log.Errorf("db error: giving up %d conditions for now: %v", len(batch), err)
+			return conditionInsertResult{requeue: batch}
+		}
+
+		atomic.AddInt64(&conditionInsertCounter.Retried, int64(len(batch)))
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > insertBackoffMax {
+			backoff = insertBackoffMax
+		}
+	}
+
+	// 1件ずつになるまで分割して原因となったレコードを特定する
+	if len(batch) == 1 {
+		// dead letterにも書けなければWALに残したまま後で再試行する
+		dlErr := moveToDeadLetter(batch[0].condition, err)
+		if dlErr != nil {
+			log.Errorf("db error: failed to write dead letter %+v (reason: %v): %v", batch[0].condition, err, dlErr)
+			return conditionInsertResult{requeue: batch}
+		}
+		return conditionInsertResult{
+			done:         batch,
+			deadLettered: []deadLetteredCondition{{queued: batch[0], reason: err}},
+		}
+	}
+	half := len(batch) / 2
+	result := insertConditionsWithRetry(batch[:half], live)
+	result.merge(insertConditionsWithRetry(batch[half:], live))
+	return result
+}
+
+// 書き込んだ件数を返す 既にDBにあったものは含まない
+func insertConditions(conditions []IsuCondition) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// 既にDBにある(jia_isu_uuid, timestamp)は何もせず，影響を受けた行数にも数えられない
+	result, err := tx.NamedExec(
+		"INSERT INTO `isu_condition`"+
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `condition_level`)"+
+			"	VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message, :condition_level)"+
+			"	ON DUPLICATE KEY UPDATE `jia_isu_uuid` = `jia_isu_uuid`",
+		conditions)
+	if err != nil {
+		return 0, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+// 書き込めないコンディションを理由と共にdead letterテーブルへ移す
+func moveToDeadLetter(condition IsuCondition, reason error) error {
+	_, err := db.Exec(
+		"INSERT INTO `isu_condition_dead_letter`"+
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `condition_level`, `reason`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?)",
+		condition.JIAIsuUUID, condition.Timestamp, condition.IsSitting, condition.Condition,
+		condition.Message, condition.ConditionLevel, reason.Error())
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&conditionInsertCounter.Dropped, 1)
+	return nil
+}
@@ -7,15 +7,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 )
 
 type GetIsuListResponse struct {
@@ -35,13 +36,13 @@ func getIsuList(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// // c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	tx, err := db.Beginx()
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
@@ -52,7 +53,7 @@ func getIsuList(c echo.Context) error {
 		"SELECT `id`, `jia_isu_uuid`, `name`, `character` FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
 		jiaUserID)
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -66,7 +67,7 @@ func getIsuList(c echo.Context) error {
 			if errors.Is(err, sql.ErrNoRows) {
 				foundLastCondition = false
 			} else {
-				// c.Logger().Errorf("db error: %v", err)
+				c.Logger().Errorf("db error: %v", err)
 				return c.NoContent(http.StatusInternalServerError)
 			}
 		}
@@ -101,7 +102,7 @@ func getIsuList(c echo.Context) error {
 
 	err = tx.Commit()
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -111,6 +112,8 @@ func getIsuList(c echo.Context) error {
 type JIAServiceRequest struct {
 	TargetBaseURL string `json:"target_base_url"`
 	IsuUUID       string `json:"isu_uuid"`
+	// ISUがコンディションの署名に使う秘密鍵
+	ConditionSecret string `json:"condition_secret"`
 }
 
 type IsuFromJIA struct {
@@ -122,7 +125,7 @@ func getJIAServiceURL(tx *sqlx.Tx) string {
 	err := tx.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
-			log.Print(err)
+			log.Error(err)
 		}
 		return defaultJIAServiceURL
 	}
@@ -140,7 +143,7 @@ func postIsu(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -161,34 +164,40 @@ func postIsu(c echo.Context) error {
 	if useDefaultImage {
 		image, err = ioutil.ReadFile(defaultIconFilePath)
 		if err != nil {
-			// c.Logger().Error(err)
+			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	} else {
 		file, err := fh.Open()
 		if err != nil {
-			// c.Logger().Error(err)
+			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 		defer file.Close()
 
 		image, err = ioutil.ReadAll(file)
 		if err != nil {
-			// c.Logger().Error(err)
+			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
+	conditionSecret, err := generateConditionSecret()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	tx, err := db.Beginx()
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
 
 	_, err = tx.Exec("INSERT INTO `isu`"+
-		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
-		jiaIsuUUID, isuName, image, jiaUserID)
+		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`, `condition_secret`) VALUES (?, ?, ?, ?, ?)",
+		jiaIsuUUID, isuName, image, jiaUserID, conditionSecret)
 	if err != nil {
 		mysqlErr, ok := err.(*mysql.MySQLError)
 
@@ -196,55 +205,57 @@ func postIsu(c echo.Context) error {
 			return c.String(http.StatusConflict, "duplicated: isu")
 		}
 
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	if targetURL == "" {
 		targetURL = getJIAServiceURL(tx) + "/api/activate"
 	}
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID, conditionSecret}
 	bodyJSON, err := json.Marshal(body)
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodyJSON))
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	reqJIA.Header.Set("Content-Type", "application/json")
 	res, err := http.DefaultClient.Do(reqJIA)
 	if err != nil {
-		// c.Logger().Errorf("failed to request to JIAService: %v", err)
+		jiaRequests.WithLabelValues("activate", "error").Inc()
+		c.Logger().Errorf("failed to request to JIAService: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer res.Body.Close()
+	jiaRequests.WithLabelValues("activate", strconv.Itoa(res.StatusCode)).Inc()
 
 	resBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	if res.StatusCode != http.StatusAccepted {
-		// c.Logger().Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
+		c.Logger().Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
 		return c.String(res.StatusCode, "JIAService returned error")
 	}
 
 	var isuFromJIA IsuFromJIA
 	err = json.Unmarshal(resBody, &isuFromJIA)
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -254,19 +265,21 @@ func postIsu(c echo.Context) error {
 		"SELECT `id`, `jia_isu_uuid`, `name`, `character` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
 		jiaUserID, jiaIsuUUID)
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	uniqueID := jiaUserID + jiaIsuUUID
 	imageCacheMap[uniqueID] = image
 
+	registerTrendIsu(isu.ID, isu.JIAIsuUUID, isu.Character)
+
 	return c.JSON(http.StatusCreated, isu)
 }
 
@@ -279,7 +292,7 @@ func getIsuID(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -293,7 +306,7 @@ func getIsuID(c echo.Context) error {
 			return c.String(http.StatusNotFound, "not found: isu")
 		}
 
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -311,7 +324,7 @@ func getIsuIcon(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -330,7 +343,7 @@ func getIsuIcon(c echo.Context) error {
 				return c.String(http.StatusNotFound, "not found: isu")
 			}
 
-			// c.Logger().Errorf("db error: %v", err)
+			c.Logger().Errorf("db error: %v", err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 
@@ -349,7 +362,7 @@ func getIsuGraph(c echo.Context) error {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
 		}
 
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -362,35 +375,43 @@ func getIsuGraph(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusBadRequest, "bad format: datetime")
 	}
-	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+	window, errMsg := parseGraphWindow(c, time.Unix(datetimeInt64, 0))
+	if errMsg != "" {
+		return c.String(http.StatusBadRequest, errMsg)
+	}
+	precise, ok := parseGraphVersion(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: version")
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer tx.Rollback()
 
-	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+	var character sql.NullString
+	err = tx.Get(&character, "SELECT `character` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
 		jiaUserID, jiaIsuUUID)
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if count == 0 {
-		return c.String(http.StatusNotFound, "not found: isu")
-	}
 
-	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, date)
+	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, character.String, window, precise)
 	if err != nil {
-		// c.Logger().Error(err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		// c.Logger().Errorf("db error: %v", err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -404,188 +425,415 @@ type GraphResponse struct {
 	ConditionTimestamps []int64         `json:"condition_timestamps"`
 }
 
-type GraphDataPointWithInfo struct {
-	JIAIsuUUID          string
-	StartAt             time.Time
-	Data                GraphDataPoint
-	ConditionTimestamps []int64
+// グラフの1区間の長さ
+var graphIntervals = map[string]time.Duration{
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"30m": 30 * time.Minute,
+	"1h":  time.Hour,
+	"3h":  3 * time.Hour,
+	"6h":  6 * time.Hour,
+	"1d":  24 * time.Hour,
 }
 
-// グラフのデータ点を一日分生成
-func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
-	dataPoints := []GraphDataPointWithInfo{}
-	conditionsInThisHour := []IsuCondition{}
-	timestampsInThisHour := []int64{}
-	var startTimeInThisHour time.Time
-	var condition IsuCondition
+// グラフ全体の期間
+var graphRanges = map[string]func(start time.Time) time.Time{
+	"day":   func(start time.Time) time.Time { return start.AddDate(0, 0, 1) },
+	"week":  func(start time.Time) time.Time { return start.AddDate(0, 0, 7) },
+	"month": func(start time.Time) time.Time { return start.AddDate(0, 1, 0) },
+}
 
-	endTime := graphDate.Add(time.Hour * 24)
+// グラフを描く期間と区間の長さ
+type graphWindow struct {
+	start    time.Time
+	end      time.Time
+	interval time.Duration
+	// 区間の境界 先頭がstartで末尾がend
+	boundaries []time.Time
+}
 
-	rows, err := tx.Queryx(
-		"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` >= ?  AND `timestamp` < ? ORDER BY `timestamp` ASC",
-		jiaIsuUUID, graphDate, endTime)
-	if err != nil {
-		return nil, fmt.Errorf("db error: %v", err)
+// interval,rangeを省略すると1時間毎に1日分
+// 区間の境界はtzの地域の時刻で決め，省略時はDBに保存している時刻の地域を使う
+func parseGraphWindow(c echo.Context, datetime time.Time) (graphWindow, string) {
+	intervalStr := c.QueryParam("interval")
+	if intervalStr == "" {
+		intervalStr = defaultGraphInterval
+	}
+	interval, ok := graphIntervals[intervalStr]
+	if !ok {
+		return graphWindow{}, "bad format: interval"
 	}
 
-	for rows.Next() {
-		err = rows.StructScan(&condition)
-		if err != nil {
-			return nil, err
-		}
+	rangeStr := c.QueryParam("range")
+	if rangeStr == "" {
+		rangeStr = defaultGraphRange
+	}
+	rangeEnd, ok := graphRanges[rangeStr]
+	if !ok {
+		return graphWindow{}, "bad format: range"
+	}
 
-		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
-		if truncatedConditionTime != startTimeInThisHour {
-			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
-				if err != nil {
-					return nil, err
-				}
-
-				dataPoints = append(dataPoints,
-					GraphDataPointWithInfo{
-						JIAIsuUUID:          jiaIsuUUID,
-						StartAt:             startTimeInThisHour,
-						Data:                data,
-						ConditionTimestamps: timestampsInThisHour})
-			}
+	loc, ok := parseTimezone(c)
+	if !ok {
+		return graphWindow{}, "bad format: tz"
+	}
+	if loc == nil {
+		loc = storageLocation
+	}
 
-			startTimeInThisHour = truncatedConditionTime
-			conditionsInThisHour = []IsuCondition{}
-			timestampsInThisHour = []int64{}
-		}
-		conditionsInThisHour = append(conditionsInThisHour, condition)
-		timestampsInThisHour = append(timestampsInThisHour, condition.Timestamp.Unix())
+	// 1時間より長い区間はdatetimeの時刻から数える
+	truncate := interval
+	if truncate > time.Hour {
+		truncate = time.Hour
+	}
+	start := truncateInLocation(datetime, truncate, loc)
+	end := rangeEnd(start)
+	if int((end.Sub(start)+interval-1)/interval) > graphMaxBuckets {
+		return graphWindow{}, "too many data points: interval is too short for range"
 	}
+	return newGraphWindow(start, end, interval), ""
+}
 
-	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
-		if err != nil {
-			return nil, err
+// 1日毎の区間は夏時間の切り替わる日も暦の上の1日にする
+func newGraphWindow(start, end time.Time, interval time.Duration) graphWindow {
+	w := graphWindow{start: start, end: end, interval: interval}
+	for t := start; t.Before(end); {
+		w.boundaries = append(w.boundaries, t)
+		if interval == 24*time.Hour {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			t = t.Add(interval)
 		}
+	}
+	w.boundaries = append(w.boundaries, end)
+	return w
+}
 
-		dataPoints = append(dataPoints,
-			GraphDataPointWithInfo{
-				JIAIsuUUID:          jiaIsuUUID,
-				StartAt:             startTimeInThisHour,
-				Data:                data,
-				ConditionTimestamps: timestampsInThisHour})
+// 地域の時計で区切る 30分ずれた時差の地域でも正時やその日の0時に揃う
+func truncateInLocation(t time.Time, d time.Duration, loc *time.Location) time.Time {
+	lt := t.In(loc)
+	step := int(d / time.Minute)
+	minutes := lt.Hour()*60 + lt.Minute()
+	return time.Date(lt.Year(), lt.Month(), lt.Day(), 0, minutes/step*step, 0, 0, loc)
+}
+
+// 時刻が含まれる区間の開始時刻
+func (w graphWindow) bucketStart(t time.Time) time.Time {
+	i := sort.Search(len(w.boundaries), func(i int) bool { return w.boundaries[i].After(t) }) - 1
+	if i < 0 {
+		i = 0
 	}
+	return w.boundaries[i]
+}
 
-	startIndex := len(dataPoints)
-	endNextIndex := len(dataPoints)
-	for i, graph := range dataPoints {
-		if startIndex == len(dataPoints) && !graph.StartAt.Before(graphDate) {
-			startIndex = i
-		}
-		if endNextIndex == len(dataPoints) && graph.StartAt.After(endTime) {
-			endNextIndex = i
+// 全ての区間の境界がDBに保存する地域の正時ならisu_condition_hourlyの集計を使える
+func (w graphWindow) alignedToHours() bool {
+	for _, b := range w.boundaries {
+		if !b.Equal(conditionRollupHour(b)) {
+			return false
 		}
 	}
+	return true
+}
 
-	filteredDataPoints := []GraphDataPointWithInfo{}
-	if startIndex < endNextIndex {
-		filteredDataPoints = dataPoints[startIndex:endNextIndex]
+// 期間内のグラフのデータ点を区間毎に生成
+func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, character string, window graphWindow, precise bool) ([]GraphResponse, error) {
+	aggregates, err := getIsuGraphAggregates(tx, jiaIsuUUID, character, window)
+	if err != nil {
+		return nil, err
 	}
 
 	responseList := []GraphResponse{}
-	index := 0
-	thisTime := graphDate
-
-	for thisTime.Before(endTime) {
+	for i := 0; i+1 < len(window.boundaries); i++ {
+		thisTime, bucketEnd := window.boundaries[i], window.boundaries[i+1]
 		var data *GraphDataPoint
 		timestamps := []int64{}
 
-		if index < len(filteredDataPoints) {
-			dataWithInfo := filteredDataPoints[index]
-
-			if dataWithInfo.StartAt.Equal(thisTime) {
-				data = &dataWithInfo.Data
-				timestamps = dataWithInfo.ConditionTimestamps
-				index++
-			}
+		if a, ok := aggregates[thisTime.Unix()]; ok && a.count > 0 {
+			d := a.dataPoint(precise)
+			data = &d
+			timestamps = a.timestamps
 		}
 
 		resp := GraphResponse{
 			StartAt:             thisTime.Unix(),
-			EndAt:               thisTime.Add(time.Hour).Unix(),
+			EndAt:               bucketEnd.Unix(),
 			Data:                data,
 			ConditionTimestamps: timestamps,
 		}
 		responseList = append(responseList, resp)
-
-		thisTime = thisTime.Add(time.Hour)
 	}
 
 	return responseList, nil
 }
 
+// 期間内のコンディションを区間の開始時刻毎に集計する
+// 1時間単位の区間では，今の時間より前は集計済みのisu_condition_hourlyから読む
+func getIsuGraphAggregates(tx *sqlx.Tx, jiaIsuUUID string, character string, window graphWindow) (map[int64]*graphAggregate, error) {
+	schema := conditionSchemas.ForIsu(jiaIsuUUID)
+	aggregates := map[int64]*graphAggregate{}
+	bucket := func(t time.Time) *graphAggregate {
+		start := window.bucketStart(t).Unix()
+		a, ok := aggregates[start]
+		if !ok {
+			a = newGraphAggregate(schema)
+			aggregates[start] = a
+		}
+		return a
+	}
+
+	rawFrom := window.start
+	if window.alignedToHours() {
+		rawFrom = conditionRollupHour(time.Now())
+		if rawFrom.Before(window.start) {
+			rawFrom = window.start
+		}
+		if rawFrom.After(window.end) {
+			rawFrom = window.end
+		}
+		// まだ集計を作り直していない時間からはisu_conditionから読む
+		if pending, ok := firstPendingConditionRollup(jiaIsuUUID, window.start, rawFrom); ok {
+			rawFrom = pending
+		}
+
+		rollups, err := getConditionRollups(tx, jiaIsuUUID, window.start, rawFrom)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rollups {
+			a, err := r.aggregate()
+			if err != nil {
+				return nil, err
+			}
+			bucket(r.Hour).merge(a)
+		}
+	}
+
+	rows, err := tx.Queryx(
+		"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` >= ?  AND `timestamp` < ? ORDER BY `timestamp` ASC",
+		jiaIsuUUID, rawFrom, window.end)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var condition IsuCondition
+		err = rows.StructScan(&condition)
+		if err != nil {
+			return nil, err
+		}
+
+		bucket(condition.Timestamp).add(schema, condition, character)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	return aggregates, nil
+}
+
 type GraphDataPoint struct {
-	Score      int                  `json:"score"`
+	Score int `json:"score"`
+	// "sitting"とコンディションの項目毎の割合
 	Percentage ConditionsPercentage `json:"percentage"`
+	// version=2の時だけ返す 切り捨てていない値
+	Precise *PreciseGraphDataPoint `json:"precise,omitempty"`
 }
 
-type ConditionsPercentage struct {
-	Sitting      int `json:"sitting"`
-	IsBroken     int `json:"is_broken"`
-	IsDirty      int `json:"is_dirty"`
-	IsOverweight int `json:"is_overweight"`
-}
+type ConditionsPercentage map[string]int
 
-// 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
-	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
-	rawScore := 0
-	for _, condition := range isuConditions {
-		badConditionsCount := 0
+// "sitting"を先頭に残りを名前順に並べる
+// デフォルトのスキーマでは項目毎のフィールドを持っていた頃と同じ順序になる
+func (p ConditionsPercentage) MarshalJSON() ([]byte, error) {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		if key != "sitting" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := p["sitting"]; ok {
+		keys = append([]string{"sitting"}, keys...)
+	}
 
-		if !isValidConditionFormat(condition.Condition) {
-			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
 		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.WriteString(strconv.Itoa(p[key]))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
 
-		for _, condStr := range strings.Split(condition.Condition, ",") {
-			keyValue := strings.Split(condStr, "=")
+type PreciseGraphDataPoint struct {
+	Score      float64            `json:"score"`
+	Percentage map[string]float64 `json:"percentage"`
+	// 区間内のコンディションの件数
+	Count int `json:"count"`
+	// スコアの低い順にcritical, warning, infoとした時の区間内の最小と最大
+	MinLevel string `json:"min_level"`
+	MaxLevel string `json:"max_level"`
+	// コンディション毎のスコアの標準偏差
+	ScoreStddev float64 `json:"score_stddev"`
+}
 
-			conditionName := keyValue[0]
-			if keyValue[1] == "true" {
-				conditionsCount[conditionName] += 1
-				badConditionsCount++
-			}
-		}
+// version=2なら切り捨てていない値も返す
+func parseGraphVersion(c echo.Context) (bool, bool) {
+	switch c.QueryParam("version") {
+	case "", "1":
+		return false, true
+	case "2":
+		return true, true
+	}
+	return false, false
+}
 
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
+// グラフのデータ点の元になるコンディションの件数
+// 足し合わせられるので1時間毎の集計をまとめて大きな区間にできる
+type graphAggregate struct {
+	count        int
+	sittingCount int
+	// コンディションレベル毎の件数
+	infoCount     int
+	warningCount  int
+	criticalCount int
+	// コンディションの項目毎のtrueの件数
+	flagCounts map[string]int
+	timestamps []int64
+}
+
+// flagCountsはスキーマの項目を0で埋めておき，件数が無くても割合を返す
+func newGraphAggregate(schema ConditionSchema) *graphAggregate {
+	a := &graphAggregate{flagCounts: map[string]int{}, timestamps: []int64{}}
+	for _, key := range schema.Keys {
+		a.flagCounts[key.Name] = 0
 	}
+	return a
+}
 
-	sittingCount := 0
-	for _, condition := range isuConditions {
-		if condition.IsSitting {
-			sittingCount++
+// 保存済みのコンディションを足す スキーマが変わる前の行も数えられる
+func (a *graphAggregate) add(schema ConditionSchema, condition IsuCondition, character string) {
+	values := schema.ParseStored(condition.Condition)
+	for name, value := range values {
+		if value {
+			a.flagCounts[name] += 1
 		}
 	}
 
-	isuConditionsLength := len(isuConditions)
+	switch conditionLevelPolicy.Level(schema, character, values) {
+	case conditionLevelCritical:
+		a.criticalCount++
+	case conditionLevelWarning:
+		a.warningCount++
+	default:
+		a.infoCount++
+	}
+
+	if condition.IsSitting {
+		a.sittingCount++
+	}
+	a.count++
+	a.timestamps = append(a.timestamps, condition.Timestamp.Unix())
+}
+
+// 後の時間の集計を足し合わせる
+func (a *graphAggregate) merge(b *graphAggregate) {
+	a.count += b.count
+	a.sittingCount += b.sittingCount
+	a.infoCount += b.infoCount
+	a.warningCount += b.warningCount
+	a.criticalCount += b.criticalCount
+	for name, count := range b.flagCounts {
+		a.flagCounts[name] += count
+	}
+	a.timestamps = append(a.timestamps, b.timestamps...)
+}
+
+func (a *graphAggregate) rawScore() int {
+	return a.infoCount*scoreConditionLevelInfo + a.warningCount*scoreConditionLevelWarning +
+		a.criticalCount*scoreConditionLevelCritical
+}
 
-	score := rawScore * 100 / 3 / isuConditionsLength
+// グラフの一つのデータ点を計算
+// ISUのグラフの区間も比較グラフの平均もここで採点し，精密な値と従来の値がずれないようにする
+func (a *graphAggregate) dataPoint(precise bool) GraphDataPoint {
+	score := a.rawScore() * 100 / 3 / a.count
 
-	sittingPercentage := sittingCount * 100 / isuConditionsLength
-	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
-	isOverweightPercentage := conditionsCount["is_overweight"] * 100 / isuConditionsLength
-	isDirtyPercentage := conditionsCount["is_dirty"] * 100 / isuConditionsLength
+	percentage := ConditionsPercentage{
+		"sitting": a.sittingCount * 100 / a.count,
+	}
+	for name, count := range a.flagCounts {
+		percentage[name] = count * 100 / a.count
+	}
 
 	dataPoint := GraphDataPoint{
-		Score: score,
-		Percentage: ConditionsPercentage{
-			Sitting:      sittingPercentage,
-			IsBroken:     isBrokenPercentage,
-			IsOverweight: isOverweightPercentage,
-			IsDirty:      isDirtyPercentage,
-		},
-	}
-	return dataPoint, nil
+		Score:      score,
+		Percentage: percentage,
+	}
+	if precise {
+		dataPoint.Precise = a.preciseDataPoint()
+	}
+	return dataPoint
+}
+
+func (a *graphAggregate) preciseDataPoint() *PreciseGraphDataPoint {
+	n := float64(a.count)
+
+	percentage := map[string]float64{
+		"sitting": float64(a.sittingCount) * 100 / n,
+	}
+	for name, count := range a.flagCounts {
+		percentage[name] = float64(count) * 100 / n
+	}
+
+	// レベル毎のスコアは1,2,3なので件数から分散が求まる
+	mean := float64(a.rawScore()) / n
+	squareMean := float64(a.infoCount*scoreConditionLevelInfo*scoreConditionLevelInfo+
+		a.warningCount*scoreConditionLevelWarning*scoreConditionLevelWarning+
+		a.criticalCount*scoreConditionLevelCritical*scoreConditionLevelCritical) / n
+	variance := squareMean - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+
+	return &PreciseGraphDataPoint{
+		Score:       mean * 100 / 3,
+		Percentage:  percentage,
+		Count:       a.count,
+		MinLevel:    a.minLevel(),
+		MaxLevel:    a.maxLevel(),
+		ScoreStddev: math.Sqrt(variance) * 100 / 3,
+	}
+}
+
+func (a *graphAggregate) minLevel() string {
+	switch {
+	case a.criticalCount > 0:
+		return conditionLevelCritical
+	case a.warningCount > 0:
+		return conditionLevelWarning
+	default:
+		return conditionLevelInfo
+	}
+}
+
+func (a *graphAggregate) maxLevel() string {
+	switch {
+	case a.infoCount > 0:
+		return conditionLevelInfo
+	case a.warningCount > 0:
+		return conditionLevelWarning
+	default:
+		return conditionLevelCritical
+	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	logHeader       = `{"time":"${time_rfc3339_nano}","level":"${level}"}`
+	accessLogFormat = `{"time":"${time_rfc3339_nano}","request_id":"${id}","method":"${method}","uri":"${uri}",` +
+		`"status":${status},"error":"${error}","latency":${latency},"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n"
+
+	defaultLogLevel                = "error"
+	defaultConditionPostSampleRate = 100
+)
+
+var logLevels = map[string]log.Lvl{
+	"debug": log.DEBUG,
+	"info":  log.INFO,
+	"warn":  log.WARN,
+	"error": log.ERROR,
+	"off":   log.OFF,
+}
+
+func parseLogLevel(s string) (log.Lvl, error) {
+	lvl, ok := logLevels[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level: %s", s)
+	}
+	return lvl, nil
+}
+
+func logLevelName(lvl log.Lvl) string {
+	for name, l := range logLevels {
+		if l == lvl {
+			return name
+		}
+	}
+	return strconv.Itoa(int(lvl))
+}
+
+// echoのロガーとバックグラウンド処理が使うロガーのレベルを変える
+func setLogLevel(e *echo.Echo, lvl log.Lvl) {
+	e.Logger.SetLevel(lvl)
+	log.SetLevel(lvl)
+}
+
+// リクエストIDとルートを付けてJSONで出力するロガー
+type requestLogger struct {
+	echo.Logger
+	fields log.JSON
+}
+
+func (l requestLogger) logj(lvl log.Lvl, message string) {
+	j := log.JSON{"message": message}
+	for k, v := range l.fields {
+		j[k] = v
+	}
+
+	switch lvl {
+	case log.DEBUG:
+		l.Logger.Debugj(j)
+	case log.INFO:
+		l.Logger.Infoj(j)
+	case log.WARN:
+		l.Logger.Warnj(j)
+	default:
+		l.Logger.Errorj(j)
+	}
+}
+
+func (l requestLogger) Debug(i ...interface{}) {
+	if l.Level() <= log.DEBUG {
+		l.logj(log.DEBUG, fmt.Sprint(i...))
+	}
+}
+
+func (l requestLogger) Debugf(format string, args ...interface{}) {
+	if l.Level() <= log.DEBUG {
+		l.logj(log.DEBUG, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l requestLogger) Info(i ...interface{}) {
+	if l.Level() <= log.INFO {
+		l.logj(log.INFO, fmt.Sprint(i...))
+	}
+}
+
+func (l requestLogger) Infof(format string, args ...interface{}) {
+	if l.Level() <= log.INFO {
+		l.logj(log.INFO, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l requestLogger) Warn(i ...interface{}) {
+	if l.Level() <= log.WARN {
+		l.logj(log.WARN, fmt.Sprint(i...))
+	}
+}
+
+func (l requestLogger) Warnf(format string, args ...interface{}) {
+	if l.Level() <= log.WARN {
+		l.logj(log.WARN, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l requestLogger) Error(i ...interface{}) {
+	if l.Level() <= log.ERROR {
+		l.logj(log.ERROR, fmt.Sprint(i...))
+	}
+}
+
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	if l.Level() <= log.ERROR {
+		l.logj(log.ERROR, fmt.Sprintf(format, args...))
+	}
+}
+
+// c.Logger()でリクエストIDとハンドラが分かるロガーを使えるようにする
+// middleware.RequestIDの後に置くこと
+func requestLoggerMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.SetLogger(requestLogger{
+			Logger: c.Echo().Logger,
+			fields: log.JSON{
+				"request_id": c.Response().Header().Get(echo.HeaderXRequestID),
+				"method":     c.Request().Method,
+				"route":      c.Path(),
+			},
+		})
+		return next(c)
+	}
+}
+
+// アクセスログ INFO以下のレベルの時だけ出力し，
+// POST /api/condition/:jia_isu_uuid はsampleRate件に1件だけ出力する
+func accessLogMiddleware(sampleRate uint64) echo.MiddlewareFunc {
+	var conditionPostCount uint64
+	return middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Skipper: func(c echo.Context) bool {
+			if c.Echo().Logger.Level() > log.INFO {
+				return true
+			}
+			if c.Request().Method == "POST" && c.Path() == "/api/condition/:jia_isu_uuid" {
+				return atomic.AddUint64(&conditionPostCount, 1)%sampleRate != 0
+			}
+			return false
+		},
+		Format: accessLogFormat,
+	})
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,6 +27,8 @@ import (
 const (
 	sessionName                 = "isucondition_go"
 	conditionLimit              = 20
+	conditionMaxLimit           = 1000
+	conditionNextCursorHeader   = "X-Next-Cursor"
 	frontendContentsPath        = "../public"
 	jiaJWTSigningKeyPath        = "../ec256-public.pem"
 	defaultIconFilePath         = "../NoImage.jpg"
@@ -35,6 +43,27 @@ const (
 
 	trendTickerTime  = 1300
 	insertTickerTime = 400
+
+	defaultConditionWALDir     = "./wal"
+	conditionWALMaxSegmentSize = 4 << 20
+
+	shutdownTimeout = 10 * time.Second
+
+	defaultConditionQueueCapacity = 10000
+	defaultConditionWriterWorkers = 2
+	defaultConditionBatchMaxRows  = 1000
+	defaultConditionBatchMaxBytes = 1 << 20
+	conditionQueueRetryAfter      = 1 // 秒
+
+	defaultAdminAddr = "127.0.0.1:9100"
+
+	defaultTrendReconcileInterval = 1 * time.Minute
+
+	defaultGraphInterval = "1h"
+	defaultGraphRange    = "day"
+	graphMaxBuckets      = 1000
+
+	defaultStorageTimezone = "Asia/Tokyo"
 )
 
 type MySQLConnectionEnv struct {
@@ -43,12 +72,15 @@ type MySQLConnectionEnv struct {
 	User     string
 	DBName   string
 	Password string
+	Timezone string
 }
 
 var (
 	db                  *sqlx.DB
 	sessionStore        sessions.Store
 	mySQLConnectionData *MySQLConnectionEnv
+	// DBのDATETIMEの列の時刻の地域
+	storageLocation = time.Local
 
 	jiaJWTSigningKey *ecdsa.PublicKey
 
@@ -90,6 +122,22 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	val, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || val <= 0 {
+		return defaultValue
+	}
+	return val
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	val, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || val < 0 {
+		return defaultValue
+	}
+	return val
+}
+
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
@@ -97,13 +145,15 @@ func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 		User:     getEnv("MYSQL_USER", "isucon"),
 		DBName:   getEnv("MYSQL_DBNAME", "isucondition"),
 		Password: getEnv("MYSQL_PASS", "isucon"),
+		Timezone: getEnv("MYSQL_TIMEZONE", defaultStorageTimezone),
 	}
 }
 
+// DATETIMEの列はTimezoneの地域の時刻として読み書きする
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
 	dsn := fmt.Sprintf(
-		"%v:%v@tcp(%v:%v)/%v?interpolateParams=true&collation=utf8mb4_bin&parseTime=true&loc=Asia%%2FTokyo",
-		mc.User, mc.Password, mc.Host, mc.Port, mc.DBName,
+		"%v:%v@tcp(%v:%v)/%v?interpolateParams=true&collation=utf8mb4_bin&parseTime=true&loc=%v",
+		mc.User, mc.Password, mc.Host, mc.Port, mc.DBName, url.QueryEscape(mc.Timezone),
 	)
 	return sqlx.Open("mysql", dsn)
 }
@@ -122,13 +172,41 @@ func init() {
 	}
 }
 
+// コンディションのスキーマとレベルの判定基準を読み込む
+func loadConditionConfig() error {
+	var err error
+	conditionSchemas, err = loadConditionSchemas(os.Getenv("CONDITION_SCHEMA_PATH"))
+	if err != nil {
+		return err
+	}
+	conditionLevelPolicy, err = loadConditionLevelPolicy(os.Getenv("CONDITION_LEVEL_POLICY_PATH"))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
 	e := echo.New()
 	// e.Debug = true
-	// e.Logger.SetLevel(log.DEBUG)
-	e.Logger.SetLevel(log.OFF)
+	e.Logger.SetHeader(logHeader)
+	log.SetHeader(logHeader)
+	logLevel, err := parseLogLevel(getEnv("LOG_LEVEL", defaultLogLevel))
+	if err != nil {
+		e.Logger.Fatal(err)
+		return
+	}
+	setLogLevel(e, logLevel)
 
-	//	e.Use(middleware.Logger())
+	e.Use(middleware.RequestID())
+	e.Use(metricsMiddleware)
+	e.Use(requestLoggerMiddleware)
+	e.Use(accessLogMiddleware(uint64(getEnvInt("LOG_SAMPLE_RATE_CONDITION_POST", defaultConditionPostSampleRate))))
 	e.Use(middleware.Recover())
 
 	e.POST("/initialize", postInitialize)
@@ -141,10 +219,22 @@ func main() {
 	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
 	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
 	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
+	e.GET("/api/graph/compare", getCompareGraph)
+	e.GET("/api/condition/search", searchConditions)
 	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
+	e.GET("/api/condition/:jia_isu_uuid/feed", getIsuConditionFeed)
+	e.GET("/api/condition/:jia_isu_uuid/export", getIsuConditionsExport)
 	e.GET("/api/trend", getTrend)
+	e.GET("/api/trend/stream", getTrendStream)
+	e.GET("/api/alert", getAlerts)
+	e.GET("/api/alert/rule", getAlertRules)
+	e.POST("/api/alert/rule", postAlertRule)
+	e.GET("/api/alert/rule/:rule_id", getAlertRule)
+	e.PUT("/api/alert/rule/:rule_id", putAlertRule)
+	e.DELETE("/api/alert/rule/:rule_id", deleteAlertRule)
 
 	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+	e.POST("/api/condition/:jia_isu_uuid/import", postIsuConditionsImport)
 
 	e.GET("/", getIndex)
 	e.GET("/isu/:jia_isu_uuid", getIndex)
@@ -154,8 +244,12 @@ func main() {
 	e.Static("/assets", frontendContentsPath+"/assets")
 
 	mySQLConnectionData = NewMySQLConnectionEnv()
+	storageLocation, err = time.LoadLocation(mySQLConnectionData.Timezone)
+	if err != nil {
+		e.Logger.Fatalf("invalid MYSQL_TIMEZONE: %v", err)
+		return
+	}
 
-	var err error
 	db, err = mySQLConnectionData.ConnectDB()
 	if err != nil {
 		e.Logger.Fatalf("failed to connect db: %v", err)
@@ -170,8 +264,66 @@ func main() {
 		return
 	}
 
-	go insertConditionTicker()
-	go resetTrendCacheTicker()
+	requireSignedCondition = os.Getenv("REQUIRE_SIGNED_CONDITION") == "1"
+
+	err = loadConditionConfig()
+	if err != nil {
+		e.Logger.Fatalf("failed to load condition config: %v", err)
+		return
+	}
+
+	conditionLog, err = openConditionWAL(getEnv("CONDITION_WAL_DIR", defaultConditionWALDir), conditionWALMaxSegmentSize)
+	if err != nil {
+		e.Logger.Fatalf("failed to open wal: %v", err)
+		return
+	}
+	defer conditionLog.Close()
+
+	// WALから復元したコンディションの時間も集計し直し，アラートも評価する
+	conditionCommitHooks = append(conditionCommitHooks, updateConditionRollups)
+	err = loadAlertRules()
+	if err != nil {
+		e.Logger.Fatalf("failed to load alert rules: %v", err)
+		return
+	}
+	liveConditionCommitHooks = append(liveConditionCommitHooks, evaluateAlertRules)
+
+	replayed, err := replayConditionWAL()
+	if err != nil {
+		e.Logger.Fatalf("failed to replay wal: %v", err)
+		return
+	}
+	if replayed > 0 {
+		log.Infof("replayed %d conditions from wal", replayed)
+	}
+
+	err = reconcileTrend(context.Background())
+	if err != nil {
+		e.Logger.Fatalf("failed to load trend: %v", err)
+		return
+	}
+	conditionCommitHooks = append(conditionCommitHooks, updateTrendWithConditions)
+
+	insertQueue = newConditionQueue(getEnvInt("CONDITION_QUEUE_CAPACITY", defaultConditionQueueCapacity))
+	writerConfig := conditionWriterConfig{
+		maxBatchRows:  getEnvInt("CONDITION_BATCH_MAX_ROWS", defaultConditionBatchMaxRows),
+		maxBatchBytes: getEnvInt("CONDITION_BATCH_MAX_BYTES", defaultConditionBatchMaxBytes),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	workers := &sync.WaitGroup{}
+	for i := 0; i < getEnvInt("CONDITION_WRITER_WORKERS", defaultConditionWriterWorkers); i++ {
+		workers.Add(1)
+		go conditionWriter(ctx, workers, writerConfig)
+	}
+	trendReconcileInterval := getEnvDuration("TREND_RECONCILE_INTERVAL", defaultTrendReconcileInterval)
+	trendMaxStaleness = trendStalenessLimit(getEnvDuration("TREND_MAX_STALENESS", 0), trendReconcileInterval)
+	workers.Add(1)
+	go resetTrendCacheTicker(ctx, workers, trendReconcileInterval)
+	workers.Add(1)
+	go alertTicker(ctx, workers)
+	workers.Add(1)
+	go conditionRollupWorker(ctx, workers)
 
 	socketFilePath := "/temp/isucon.sock"
 	listener, err := net.Listen("unix", socketFilePath)
@@ -181,21 +333,61 @@ func main() {
 	if err := os.Chmod(socketFilePath, 0777); err != nil {
 		log.Panic(err)
 	}
-	closeFunc := func() {
-		listener.Close()
-		os.Remove(socketFilePath)
-		os.Exit(0)
-	}
+	defer os.Remove(socketFilePath)
+
 	s := make(chan os.Signal, 1)
-	signal.Notify(s, os.Interrupt, os.Kill, syscall.SIGTERM)
-	go func(s chan os.Signal) {
-		<-s
-		closeFunc()
-	}(s)
-	defer closeFunc()
+	signal.Notify(s, os.Interrupt, syscall.SIGTERM)
 
 	e.Listener = listener
-	e.Logger.Panic(e.Start(""))
+	go func() {
+		err := e.Start("")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	registerRuntimeMetrics()
+	admin := newAdminServer(e)
+	go func() {
+		err := admin.Start(getEnv("ADMIN_ADDR", defaultAdminAddr))
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	<-s
+	shutdown([]*echo.Echo{e, admin}, cancel, workers)
+}
+
+// 新規接続の受付を止め，処理中のリクエストとバックグラウンドの処理を終わらせる
+// 戻った後にWALとDBを閉じる
+func shutdown(servers []*echo.Echo, cancel context.CancelFunc, workers *sync.WaitGroup) {
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelTimeout()
+
+	// 終わらないstreamを先に閉じておく
+	trendEvents.closeAll()
+	conditionFeed.closeAll()
+
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("failed to shutdown server: %v", err)
+		}
+	}
+
+	// conditionWriterは止まる前にキューに残っているコンディションを書き込む
+	cancel()
+	workers.Wait()
+
+	// writerの最後の書き込みで積まれたアラートの変化を書き込む
+	err := flushAlertTransitions()
+	if err != nil {
+		log.Errorf("failed to write alerts: %v", err)
+	}
+
+	// writerの最後の書き込みで積まれた時間の集計を作り直す
+	processConditionRollups()
 }
 
 func getIndex(c echo.Context) error {
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// isu_conditionへのINSERTだけを受け付けるテスト用のドライバ
+// failingの間はコミットが接続断で失敗し，再試行の対象になる
+type conditionStore struct {
+	rows    map[string]struct{}
+	failing bool
+	sync.Mutex
+}
+
+func (s *conditionStore) setFailing(failing bool) {
+	s.Lock()
+	s.failing = failing
+	s.Unlock()
+}
+
+func (s *conditionStore) has(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.rows[key]
+	return ok
+}
+
+func (s *conditionStore) Open(name string) (driver.Conn, error) {
+	return &conditionStoreConn{store: s}, nil
+}
+
+type conditionStoreConn struct {
+	store   *conditionStore
+	pending []string
+}
+
+func (c *conditionStoreConn) Prepare(query string) (driver.Stmt, error) {
+	return &conditionStoreStmt{conn: c, query: query}, nil
+}
+
+func (c *conditionStoreConn) Close() error { return nil }
+
+func (c *conditionStoreConn) Begin() (driver.Tx, error) {
+	c.pending = nil
+	return c, nil
+}
+
+func (c *conditionStoreConn) Commit() error {
+	c.store.Lock()
+	defer c.store.Unlock()
+
+	if c.store.failing {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	for _, key := range c.pending {
+		c.store.rows[key] = struct{}{}
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *conditionStoreConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type conditionStoreStmt struct {
+	conn  *conditionStoreConn
+	query string
+}
+
+func (s *conditionStoreStmt) Close() error  { return nil }
+func (s *conditionStoreStmt) NumInput() int { return -1 }
+
+// (jia_isu_uuid, timestamp, is_sitting, condition, message, condition_level) の並びを記録する
+func (s *conditionStoreStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(s.query, "INSERT INTO `isu_condition`") {
+		return nil, fmt.Errorf("unexpected query: %s", s.query)
+	}
+	for i := 0; i+5 < len(args); i += 6 {
+		s.conn.pending = append(s.conn.pending, conditionStoreKey(args[i].(string), args[i+1].(time.Time)))
+	}
+	return driver.RowsAffected(len(args) / 6), nil
+}
+
+func (s *conditionStoreStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+func conditionStoreKey(jiaIsuUUID string, timestamp time.Time) string {
+	return fmt.Sprintf("%s/%d", jiaIsuUUID, timestamp.Unix())
+}
+
+var testConditionStore = &conditionStore{rows: map[string]struct{}{}}
+
+// クエリ毎にテストが決めた結果を返すテスト用のドライバ
+// handlerにはsqlx.Inで展開した後のクエリと引数が渡る
+type fakeDBHandler func(query string, args []driver.Value) (fakeResult, error)
+
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+type fakeDB struct {
+	handler fakeDBHandler
+	sync.Mutex
+}
+
+func (d *fakeDB) Open(name string) (driver.Conn, error) {
+	return &fakeConn{db: d}, nil
+}
+
+func (d *fakeDB) handle(query string, args []driver.Value) (fakeResult, error) {
+	d.Lock()
+	handler := d.handler
+	d.Unlock()
+	return handler(query, args)
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res, err := s.db.handle(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res, err := s.db.handle(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var testFakeDB = &fakeDB{}
+
+func init() {
+	sql.Register("isucondition-test", testConditionStore)
+	sql.Register("isucondition-fake", testFakeDB)
+}
+
+// テストの間だけdbをhandlerが応えるDBに差し替える
+func useFakeDB(t *testing.T, handler fakeDBHandler) {
+	testFakeDB.Lock()
+	testFakeDB.handler = handler
+	testFakeDB.Unlock()
+
+	sqlDB, err := sql.Open("isucondition-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := db
+	db = sqlx.NewDb(sqlDB, "mysql")
+	t.Cleanup(func() {
+		db.Close()
+		db = prev
+	})
+}
+
+var isuConditionColumns = []string{"id", "jia_isu_uuid", "timestamp", "is_sitting", "condition", "message", "condition_level", "created_at"}
+
+// SELECT * FROM `isu_condition` の結果の行
+func isuConditionRows(conditions []IsuCondition) [][]driver.Value {
+	rows := [][]driver.Value{}
+	for _, c := range conditions {
+		rows = append(rows, []driver.Value{
+			int64(c.ID), c.JIAIsuUUID, c.Timestamp, c.IsSitting, c.Condition, c.Message, c.ConditionLevel, c.CreatedAt,
+		})
+	}
+	return rows
+}
+
+// SIGTERMで止めても，202を返したコンディションはDBに書き込まれているかWALから復元される
+func TestShutdownKeepsAcceptedConditions(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+
+	sqlDB, err := sql.Open("isucondition-test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = sqlx.NewDb(sqlDB, "mysql")
+	defer db.Close()
+
+	walDir := t.TempDir()
+	conditionLog, err = openConditionWAL(walDir, 4<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertQueue = newConditionQueue(defaultConditionQueueCapacity)
+	conditionCommitHooks = nil
+	isuIDValidMap.validMap = map[string]*isuConditionAuth{jiaIsuUUID: {}}
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+	e.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Start("")
+	url := "http://" + e.Listener.Addr().String() + "/api/condition/" + jiaIsuUUID
+
+	ctx, cancel := context.WithCancel(context.Background())
+	workers := &sync.WaitGroup{}
+	for i := 0; i < defaultConditionWriterWorkers; i++ {
+		workers.Add(1)
+		go conditionWriter(ctx, workers, conditionWriterConfig{maxBatchRows: 50, maxBatchBytes: 1 << 20})
+	}
+
+	accepted := []int64{}
+	post := func(timestamp int64) {
+		body, _ := json.Marshal([]PostIsuConditionRequest{{
+			IsSitting: true,
+			Condition: "is_dirty=true,is_overweight=false,is_broken=false",
+			Message:   "test",
+			Timestamp: timestamp,
+		}})
+		res, err := http.Post(url, echo.MIMEApplicationJSON, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("unexpected status: %d", res.StatusCode)
+		}
+		accepted = append(accepted, timestamp)
+	}
+
+	// 前半はDBに書き込まれ，後半はDBが落ちていてWALにだけ残る
+	base := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC).Unix()
+	for i := int64(0); i < 100; i++ {
+		post(base + i)
+	}
+	time.Sleep(3 * insertTickerTime * time.Millisecond)
+	testConditionStore.setFailing(true)
+	for i := int64(100); i < 200; i++ {
+		post(base + i)
+	}
+
+	shutdown([]*echo.Echo{e}, cancel, workers)
+	err = conditionLog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 次回の起動時にWALから復元されるものを読み出す
+	replayed := map[string]struct{}{}
+	wal, err := openConditionWAL(walDir, 4<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wal.Replay(func(conditions []IsuCondition) error {
+		for _, condition := range conditions {
+			replayed[conditionStoreKey(condition.JIAIsuUUID, condition.Timestamp)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inDB, inWAL := 0, 0
+	for _, timestamp := range accepted {
+		key := conditionStoreKey(jiaIsuUUID, time.Unix(timestamp, 0))
+		_, ok := replayed[key]
+		switch {
+		case testConditionStore.has(key):
+			inDB++
+		case ok:
+			inWAL++
+		default:
+			t.Errorf("accepted condition %s was lost", key)
+		}
+	}
+	if inDB == 0 || inWAL == 0 {
+		t.Errorf("expected conditions both in db and wal: db=%d wal=%d", inDB, inWAL)
+	}
+}
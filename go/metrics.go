@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "isucondition_http_request_duration_seconds",
+		Help: "Latency of HTTP requests by route.",
+	}, []string{"method", "route", "status"})
+	conditionBatchRows = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "isucondition_condition_insert_batch_rows",
+		Help:    "Number of conditions flushed to isu_condition per batch.",
+		Buckets: []float64{1, 10, 50, 100, 250, 500, 1000, 2500, 5000},
+	})
+	trendRefreshDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "isucondition_trend_refresh_duration_seconds",
+		Help: "Time taken to rebuild the trend cache.",
+	})
+	jiaRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "isucondition_jia_requests_total",
+		Help: "Requests sent to the JIA service by result.",
+	}, []string{"endpoint", "result"})
+)
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn)
+}
+
+func newCounterFunc(name, help string, fn func() float64) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, fn)
+}
+
+// 他の処理が持っている値をスクレイプ時に読むメトリクスを登録する
+func registerRuntimeMetrics() {
+	dbStat := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			return fn(db.Stats())
+		}
+	}
+	newGaugeFunc("isucondition_db_max_open_connections", "Maximum number of open connections to the database.",
+		dbStat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	newGaugeFunc("isucondition_db_open_connections", "Number of established connections to the database.",
+		dbStat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	newGaugeFunc("isucondition_db_in_use_connections", "Number of connections currently in use.",
+		dbStat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	newGaugeFunc("isucondition_db_idle_connections", "Number of idle connections.",
+		dbStat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	newCounterFunc("isucondition_db_wait_count_total", "Total number of connections waited for.",
+		dbStat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	newCounterFunc("isucondition_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		dbStat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+
+	newGaugeFunc("isucondition_condition_queue_depth", "Conditions queued or being written to isu_condition.",
+		func() float64 {
+			insertQueue.Lock()
+			defer insertQueue.Unlock()
+			return float64(insertQueue.reserved)
+		})
+	newGaugeFunc("isucondition_condition_queue_capacity", "Capacity of the condition queue.",
+		func() float64 { return float64(insertQueue.capacity) })
+
+	newCounterFunc("isucondition_condition_inserted_total", "Conditions written to isu_condition.",
+		func() float64 { return float64(atomic.LoadInt64(&conditionInsertCounter.Inserted)) })
+	newCounterFunc("isucondition_condition_retried_total", "Conditions retried after a transient database error.",
+		func() float64 { return float64(atomic.LoadInt64(&conditionInsertCounter.Retried)) })
+	newCounterFunc("isucondition_condition_deduplicated_total", "Duplicated conditions dropped within a batch or already in isu_condition.",
+		func() float64 { return float64(atomic.LoadInt64(&conditionInsertCounter.Deduplicated)) })
+	newCounterFunc("isucondition_condition_dropped_total", "Conditions moved to the dead letter table.",
+		func() float64 { return float64(atomic.LoadInt64(&conditionInsertCounter.Dropped)) })
+
+	newGaugeFunc("isucondition_trend_cache_characters", "Number of characters in the trend cache.",
+		func() float64 {
+			trendCache.RLock()
+			defer trendCache.RUnlock()
+			return float64(len(trendCache.trend))
+		})
+	newGaugeFunc("isucondition_trend_cache_isus", "Number of ISUs in the trend cache.",
+		func() float64 {
+			trendCache.RLock()
+			defer trendCache.RUnlock()
+			n := 0
+			for _, t := range trendCache.trend {
+				n += len(t.Info) + len(t.Warning) + len(t.Critical)
+			}
+			return float64(n)
+		})
+}
+
+// ハンドラ毎のレイテンシを記録する
+// ハンドラが返したエラーはechoのエラーハンドラがレスポンスにするので，
+// HTTPErrorならそのコード，それ以外のエラーは500として記録する
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			}
+		}
+		httpRequestDuration.WithLabelValues(c.Request().Method, c.Path(), strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// GET /metrics
+// Prometheusのテキスト形式でメトリクスを出力
+var getMetrics = echo.WrapHandler(promhttp.Handler())
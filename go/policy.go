@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/labstack/gommon/log"
+)
+
+// コンディションの項目毎の値からコンディションレベルを決める
+// schemaはそのISUのコンディションのスキーマ
+type ConditionLevelPolicy interface {
+	Level(schema ConditionSchema, character string, values map[string]bool) string
+}
+
+// スキーマのWeightだけで判定する デフォルトの判定基準
+type schemaLevelPolicy struct{}
+
+func (schemaLevelPolicy) Level(schema ConditionSchema, character string, values map[string]bool) string {
+	return schema.Level(values)
+}
+
+var conditionLevelPolicy ConditionLevelPolicy = schemaLevelPolicy{}
+
+// 性格とコンディションの組み合わせ毎にレベルを決めるルール
+type ConditionLevelRule struct {
+	// 空なら全ての性格に適用する
+	Characters []string `json:"characters"`
+	// これらの項目が全てtrueかつFalseの項目が全てfalseの時に適用する
+	True  []string `json:"true"`
+	False []string `json:"false"`
+	Level string   `json:"level"`
+}
+
+// trueの項目のWeightの合計に対する閾値
+type ConditionLevelThreshold struct {
+	Warning  int `json:"warning"`
+	Critical int `json:"critical"`
+}
+
+// ルールを上から順に評価し，当てはまらなければ性格毎の閾値で判定する
+// 閾値も無い性格はスキーマのWeightで判定する
+type RuleBasedLevelPolicy struct {
+	Rules      []ConditionLevelRule               `json:"rules"`
+	Thresholds map[string]ConditionLevelThreshold `json:"thresholds"`
+}
+
+// JSONファイルから判定基準を読み込む pathが空ならデフォルトの判定基準
+func loadConditionLevelPolicy(path string) (ConditionLevelPolicy, error) {
+	if path == "" {
+		return schemaLevelPolicy{}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read condition level policy: %v", err)
+	}
+	var policy RuleBasedLevelPolicy
+	err = json.Unmarshal(b, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse condition level policy: %v", err)
+	}
+
+	for _, rule := range policy.Rules {
+		if !isValidConditionLevel(rule.Level) {
+			return nil, fmt.Errorf("invalid condition level policy: bad level %q", rule.Level)
+		}
+		for _, name := range append(append([]string{}, rule.True...), rule.False...) {
+			if !conditionSchemas.hasKey(name) {
+				return nil, fmt.Errorf("invalid condition level policy: unknown key %q", name)
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// 2_Patch.sqlがcondition_levelを計算したのと同じ判定基準か
+// デフォルトのスキーマとWeightだけの判定基準の組み合わせでなければ保存済みのレベルは計算し直す
+func isPatchConditionLevelConfig() bool {
+	if _, ok := conditionLevelPolicy.(schemaLevelPolicy); !ok {
+		return false
+	}
+	return len(conditionSchemas.Schemas) == 0 && len(conditionSchemas.Isus) == 0 &&
+		reflect.DeepEqual(conditionSchemas.Default, defaultConditionSchema)
+}
+
+func isValidConditionLevel(level string) bool {
+	switch level {
+	case conditionLevelInfo, conditionLevelWarning, conditionLevelCritical:
+		return true
+	}
+	return false
+}
+
+func (p *RuleBasedLevelPolicy) Level(schema ConditionSchema, character string, values map[string]bool) string {
+	for _, rule := range p.Rules {
+		if rule.matches(character, values) {
+			return rule.Level
+		}
+	}
+
+	threshold, ok := p.Thresholds[character]
+	if !ok {
+		return schema.Level(values)
+	}
+
+	weight := 0
+	for _, key := range schema.Keys {
+		if values[key.Name] {
+			weight += key.Weight
+		}
+	}
+	switch {
+	case threshold.Critical > 0 && weight >= threshold.Critical:
+		return conditionLevelCritical
+	case weight > 0 && weight >= threshold.Warning:
+		return conditionLevelWarning
+	default:
+		return conditionLevelInfo
+	}
+}
+
+func (r ConditionLevelRule) matches(character string, values map[string]bool) bool {
+	if len(r.Characters) > 0 {
+		found := false
+		for _, c := range r.Characters {
+			if c == character {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, name := range r.True {
+		if !values[name] {
+			return false
+		}
+	}
+	for _, name := range r.False {
+		if values[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// 保存済みのコンディションのcondition_levelを現在の判定基準で計算し直す
+// ISU毎にスキーマが異なるので，ISUとコンディションの組み合わせ毎に更新する
+// 更新した行数を返す
+func backfillConditionLevels() (int64, error) {
+	type isuAndCondition struct {
+		JIAIsuUUID string `db:"jia_isu_uuid"`
+		Character  string `db:"character"`
+		Condition  string `db:"condition"`
+	}
+	combinations := []isuAndCondition{}
+	err := db.Select(&combinations,
+		"SELECT DISTINCT `isu`.`jia_isu_uuid`, IFNULL(`isu`.`character`, '') AS `character`, `isu_condition`.`condition`"+
+			" FROM `isu_condition` INNER JOIN `isu` ON `isu`.`jia_isu_uuid` = `isu_condition`.`jia_isu_uuid`")
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+
+	var updated int64
+	for _, comb := range combinations {
+		level, err := calculateConditionLevel(comb.JIAIsuUUID, comb.Character, comb.Condition)
+		if err != nil {
+			// 今のスキーマで読めない行は元のcondition_levelのまま残す
+			log.Warnf("skipped condition %q of %s: %v", comb.Condition, comb.JIAIsuUUID, err)
+			continue
+		}
+
+		result, err := db.Exec(
+			"UPDATE `isu_condition` SET `condition_level` = ?"+
+				" WHERE `jia_isu_uuid` = ? AND `condition` = ? AND `condition_level` <> ?",
+			level, comb.JIAIsuUUID, comb.Condition, level)
+		if err != nil {
+			return updated, fmt.Errorf("db error: %v", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return updated, fmt.Errorf("db error: %v", err)
+		}
+		updated += n
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaLevel(t *testing.T) {
+	weighted := ConditionSchema{
+		Keys: []ConditionKey{
+			{Name: "is_dirty", Weight: 1},
+			{Name: "is_overweight", Weight: 1},
+			{Name: "is_broken", Weight: 3},
+		},
+		CriticalWeight: 3,
+	}
+
+	tests := []struct {
+		name   string
+		schema ConditionSchema
+		values map[string]bool
+		want   string
+	}{
+		{name: "default none", schema: defaultConditionSchema, values: map[string]bool{}, want: conditionLevelInfo},
+		{name: "default one", schema: defaultConditionSchema, values: map[string]bool{"is_dirty": true}, want: conditionLevelWarning},
+		{name: "default two", schema: defaultConditionSchema, values: map[string]bool{"is_dirty": true, "is_broken": true}, want: conditionLevelWarning},
+		{name: "default all", schema: defaultConditionSchema, values: map[string]bool{"is_dirty": true, "is_overweight": true, "is_broken": true}, want: conditionLevelCritical},
+		{name: "weighted light", schema: weighted, values: map[string]bool{"is_dirty": true, "is_overweight": true}, want: conditionLevelWarning},
+		{name: "weighted heavy", schema: weighted, values: map[string]bool{"is_broken": true}, want: conditionLevelCritical},
+		{name: "unknown key", schema: defaultConditionSchema, values: map[string]bool{"is_overheated": true}, want: conditionLevelInfo},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (schemaLevelPolicy{}).Level(tt.schema, "", tt.values); got != tt.want {
+				t.Errorf("Level() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleBasedLevelPolicy(t *testing.T) {
+	policy := &RuleBasedLevelPolicy{
+		Rules: []ConditionLevelRule{
+			{Characters: []string{"いじっぱり"}, True: []string{"is_broken"}, Level: conditionLevelCritical},
+			{True: []string{"is_dirty"}, False: []string{"is_overweight", "is_broken"}, Level: conditionLevelInfo},
+		},
+		Thresholds: map[string]ConditionLevelThreshold{
+			"おおらか": {Warning: 2, Critical: 3},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		character string
+		values    map[string]bool
+		want      string
+	}{
+		{name: "rule for character", character: "いじっぱり", values: map[string]bool{"is_broken": true}, want: conditionLevelCritical},
+		{name: "rule for other character", character: "のんき", values: map[string]bool{"is_broken": true}, want: conditionLevelWarning},
+		{name: "rule for all characters", character: "のんき", values: map[string]bool{"is_dirty": true}, want: conditionLevelInfo},
+		{name: "rule not matched by false key", character: "のんき", values: map[string]bool{"is_dirty": true, "is_overweight": true}, want: conditionLevelWarning},
+		{name: "below warning threshold", character: "おおらか", values: map[string]bool{"is_broken": true}, want: conditionLevelInfo},
+		{name: "warning threshold", character: "おおらか", values: map[string]bool{"is_overweight": true, "is_broken": true}, want: conditionLevelWarning},
+		{name: "critical threshold", character: "おおらか", values: map[string]bool{"is_dirty": true, "is_overweight": true, "is_broken": true}, want: conditionLevelCritical},
+		{name: "no threshold", character: "のんき", values: map[string]bool{"is_dirty": true, "is_overweight": true, "is_broken": true}, want: conditionLevelCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Level(defaultConditionSchema, tt.character, tt.values); got != tt.want {
+				t.Errorf("Level() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConditionLevelPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "valid", file: `{"rules":[{"true":["is_broken"],"level":"critical"}],"thresholds":{"おおらか":{"warning":2,"critical":3}}}`},
+		{name: "bad level", file: `{"rules":[{"true":["is_broken"],"level":"fatal"}]}`, wantErr: true},
+		{name: "unknown key", file: `{"rules":[{"false":["is_overheated"],"level":"info"}]}`, wantErr: true},
+		{name: "broken json", file: `{"rules":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			err := os.WriteFile(path, []byte(tt.file), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadConditionLevelPolicy(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConditionLevelPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// 2_Patch.sqlと同じ判定基準の時だけ保存済みのレベルを計算し直さずに済む
+func TestIsPatchConditionLevelConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemas ConditionSchemaRegistry
+		policy  ConditionLevelPolicy
+		want    bool
+	}{
+		{
+			name:    "default",
+			schemas: ConditionSchemaRegistry{Default: defaultConditionSchema},
+			policy:  schemaLevelPolicy{},
+			want:    true,
+		},
+		{
+			name:    "rule based policy",
+			schemas: ConditionSchemaRegistry{Default: defaultConditionSchema},
+			policy:  &RuleBasedLevelPolicy{},
+			want:    false,
+		},
+		{
+			name:    "other weights",
+			schemas: ConditionSchemaRegistry{Default: ConditionSchema{Keys: defaultConditionSchema.Keys, CriticalWeight: 2}},
+			policy:  schemaLevelPolicy{},
+			want:    false,
+		},
+		{
+			name: "per isu schema",
+			schemas: ConditionSchemaRegistry{
+				Default: defaultConditionSchema,
+				Schemas: map[string]ConditionSchema{"chair-v2": testChairSchema},
+				Isus:    map[string]string{"0694e4d7-dfce-4aec-b7ca-887ac42cfb8f": "chair-v2"},
+			},
+			policy: schemaLevelPolicy{},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schemas, policy := conditionSchemas, conditionLevelPolicy
+			defer func() { conditionSchemas, conditionLevelPolicy = schemas, policy }()
+			conditionSchemas, conditionLevelPolicy = tt.schemas, tt.policy
+
+			if got := isPatchConditionLevelConfig(); got != tt.want {
+				t.Errorf("isPatchConditionLevelConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type queuedCondition struct {
+	condition IsuCondition
+	// このコンディションを書き込んだWALのセグメント
+	walSegment uint64
+}
+
+// バッチの大きさを見積もるためのおおよそのバイト数
+func (q queuedCondition) size() int {
+	return len(q.condition.JIAIsuUUID) + len(q.condition.Condition) + len(q.condition.Message) +
+		len(q.condition.ConditionLevel) + 32
+}
+
+// postIsuConditionとwriterの間の上限付きキュー
+// reservedはキューに入っているものと書き込み中のものの合計で，
+// DBへの書き込みが終わるまで解放しない
+type conditionQueue struct {
+	ch       chan queuedCondition
+	capacity int
+	reserved int
+	sync.Mutex
+}
+
+var insertQueue *conditionQueue
+
+func newConditionQueue(capacity int) *conditionQueue {
+	return &conditionQueue{
+		ch:       make(chan queuedCondition, capacity),
+		capacity: capacity,
+	}
+}
+
+// n件を積む枠を確保する
+// 確保できた場合はchに送っても詰まらない
+func (q *conditionQueue) tryReserve(n int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.reserved+n > q.capacity {
+		return false
+	}
+	q.reserved += n
+	return true
+}
+
+func (q *conditionQueue) release(n int) {
+	q.Lock()
+	q.reserved -= n
+	q.Unlock()
+}
+
+type conditionWriterConfig struct {
+	maxBatchRows  int
+	maxBatchBytes int
+}
+
+// キューからコンディションを取り出してまとめてDBに書き込む
+// バッチが上限に達するか，insertTickerTime毎に書き込む
+func conditionWriter(ctx context.Context, wg *sync.WaitGroup, config conditionWriterConfig) {
+	defer wg.Done()
+
+	t := time.NewTicker(insertTickerTime * time.Millisecond)
+	defer t.Stop()
+
+	batch := []queuedCondition{}
+	batchBytes := 0
+	full := func() bool {
+		return len(batch) >= config.maxBatchRows || batchBytes >= config.maxBatchBytes
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// 終了前にキューに残っている分を同じ上限のバッチに分けて書き込む
+			for {
+				select {
+				case q := <-insertQueue.ch:
+					batch = append(batch, q)
+					batchBytes += q.size()
+					if full() {
+						flushConditions(batch, true)
+						batch = []queuedCondition{}
+						batchBytes = 0
+					}
+				default:
+					flushConditions(batch, true)
+					return
+				}
+			}
+		case q := <-insertQueue.ch:
+			batch = append(batch, q)
+			batchBytes += q.size()
+			if !full() {
+				continue
+			}
+		case <-t.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		flushConditions(batch, false)
+		batch = []queuedCondition{}
+		batchBytes = 0
+	}
+}
+
+// バッチをDBに書き込んでWALとキューの枠を解放する
+// 書き込めなかった分はキューに戻すが，終了時はWALに残して次回の起動時に復元させる
+func flushConditions(batch []queuedCondition, final bool) {
+	if len(batch) == 0 {
+		return
+	}
+
+	conditionBatchRows.Observe(float64(len(batch)))
+	done, requeue := insertConditionBatch(batch)
+
+	walCounts := map[uint64]int{}
+	for _, q := range done {
+		walCounts[q.walSegment]++
+	}
+	conditionLog.Ack(walCounts)
+
+	if final {
+		insertQueue.release(len(batch))
+		return
+	}
+	insertQueue.release(len(done))
+
+	// 枠は確保したままなので詰まらない
+	for _, q := range requeue {
+		insertQueue.ch <- q
+	}
+}
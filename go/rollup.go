@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	conditionRollupWriteBatchSize = 500
+	conditionRollupInterval       = 1 * time.Second
+)
+
+// isu_condition_hourlyの1行 ISU毎の1時間分のグラフの集計
+type conditionRollup struct {
+	JIAIsuUUID    string    `db:"jia_isu_uuid"`
+	Hour          time.Time `db:"hour"`
+	Count         int       `db:"count"`
+	SittingCount  int       `db:"sitting_count"`
+	InfoCount     int       `db:"info_count"`
+	WarningCount  int       `db:"warning_count"`
+	CriticalCount int       `db:"critical_count"`
+	// 項目毎のtrueの件数のJSON
+	FlagCounts string `db:"flag_counts"`
+	// コンディションの時刻のJSON配列
+	ConditionTimestamps string `db:"condition_timestamps"`
+}
+
+func newConditionRollup(jiaIsuUUID string, hour time.Time, a *graphAggregate) (conditionRollup, error) {
+	flagCounts, err := json.Marshal(a.flagCounts)
+	if err != nil {
+		return conditionRollup{}, err
+	}
+	timestamps, err := json.Marshal(a.timestamps)
+	if err != nil {
+		return conditionRollup{}, err
+	}
+	return conditionRollup{
+		JIAIsuUUID:          jiaIsuUUID,
+		Hour:                hour,
+		Count:               a.count,
+		SittingCount:        a.sittingCount,
+		InfoCount:           a.infoCount,
+		WarningCount:        a.warningCount,
+		CriticalCount:       a.criticalCount,
+		FlagCounts:          string(flagCounts),
+		ConditionTimestamps: string(timestamps),
+	}, nil
+}
+
+func (r conditionRollup) aggregate() (*graphAggregate, error) {
+	a := &graphAggregate{
+		count:         r.Count,
+		sittingCount:  r.SittingCount,
+		infoCount:     r.InfoCount,
+		warningCount:  r.WarningCount,
+		criticalCount: r.CriticalCount,
+	}
+	err := json.Unmarshal([]byte(r.FlagCounts), &a.flagCounts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rollup: %v", err)
+	}
+	err = json.Unmarshal([]byte(r.ConditionTimestamps), &a.timestamps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rollup: %v", err)
+	}
+	return a, nil
+}
+
+// 期間内の集計を時間順に取得
+func getConditionRollups(tx *sqlx.Tx, jiaIsuUUID string, start, end time.Time) ([]conditionRollup, error) {
+	rollups := []conditionRollup{}
+	if !start.Before(end) {
+		return rollups, nil
+	}
+	err := tx.Select(&rollups,
+		"SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` = ? AND `hour` >= ? AND `hour` < ? ORDER BY `hour` ASC",
+		jiaIsuUUID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return rollups, nil
+}
+
+func writeConditionRollups(e sqlx.Ext, rollups []conditionRollup) error {
+	for len(rollups) > 0 {
+		n := len(rollups)
+		if n > conditionRollupWriteBatchSize {
+			n = conditionRollupWriteBatchSize
+		}
+		_, err := sqlx.NamedExec(e,
+			"INSERT INTO `isu_condition_hourly`"+
+				"	(`jia_isu_uuid`, `hour`, `count`, `sitting_count`, `info_count`, `warning_count`, `critical_count`,"+
+				"	`flag_counts`, `condition_timestamps`)"+
+				"	VALUES (:jia_isu_uuid, :hour, :count, :sitting_count, :info_count, :warning_count, :critical_count,"+
+				"	:flag_counts, :condition_timestamps)"+
+				"	ON DUPLICATE KEY UPDATE `count` = VALUES(`count`), `sitting_count` = VALUES(`sitting_count`),"+
+				"	`info_count` = VALUES(`info_count`), `warning_count` = VALUES(`warning_count`),"+
+				"	`critical_count` = VALUES(`critical_count`), `flag_counts` = VALUES(`flag_counts`),"+
+				"	`condition_timestamps` = VALUES(`condition_timestamps`)",
+			rollups[:n])
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		rollups = rollups[n:]
+	}
+	return nil
+}
+
+// 集計する1時間の始まり
+// DBに保存する地域の正時で区切るので，UTCとの差が1時間単位でない地域でもDBの時刻と揃う
+func conditionRollupHour(t time.Time) time.Time {
+	_, offset := t.In(storageLocation).Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(time.Hour).Add(-shift)
+}
+
+// まだ集計を作り直していない時間 作り直すまでグラフはisu_conditionから読む
+var conditionRollupQueue = struct {
+	// ISU毎の時間と，その時間が最後に積まれた時の番号
+	hours map[string]map[int64]uint64
+	seq   uint64
+	// 0でなければ全ての集計を作り直すまで集計を使わない 頼まれた時の番号
+	backfill uint64
+	sync.Mutex
+}{
+	hours: map[string]map[int64]uint64{},
+}
+
+func markConditionRollups(jiaIsuUUID string, hours map[int64]struct{}) {
+	conditionRollupQueue.Lock()
+	defer conditionRollupQueue.Unlock()
+
+	pending, ok := conditionRollupQueue.hours[jiaIsuUUID]
+	if !ok {
+		pending = map[int64]uint64{}
+		conditionRollupQueue.hours[jiaIsuUUID] = pending
+	}
+	for hour := range hours {
+		conditionRollupQueue.seq++
+		pending[hour] = conditionRollupQueue.seq
+	}
+}
+
+// 全ての集計を作り直すよう頼む 作り直すまでグラフはisu_conditionから読む
+func requestConditionRollupBackfill() {
+	conditionRollupQueue.Lock()
+	defer conditionRollupQueue.Unlock()
+	conditionRollupQueue.seq++
+	conditionRollupQueue.backfill = conditionRollupQueue.seq
+}
+
+// [start, end)の中で集計を信用できない最初の時間
+func firstPendingConditionRollup(jiaIsuUUID string, start, end time.Time) (time.Time, bool) {
+	conditionRollupQueue.Lock()
+	defer conditionRollupQueue.Unlock()
+
+	if conditionRollupQueue.backfill != 0 {
+		return start, true
+	}
+	var first int64
+	found := false
+	for hour := range conditionRollupQueue.hours[jiaIsuUUID] {
+		if hour < start.Unix() || hour >= end.Unix() {
+			continue
+		}
+		if !found || hour < first {
+			first = hour
+			found = true
+		}
+	}
+	return time.Unix(first, 0), found
+}
+
+// 書き込まれたコンディションを含む時間を積んでおく
+// 数え直しはconditionRollupWorkerが行い，コンディションの書き込みを待たせない
+func updateConditionRollups(conditions []IsuCondition) {
+	hours := map[string]map[int64]struct{}{}
+	for _, condition := range conditions {
+		if hours[condition.JIAIsuUUID] == nil {
+			hours[condition.JIAIsuUUID] = map[int64]struct{}{}
+		}
+		hours[condition.JIAIsuUUID][conditionRollupHour(condition.Timestamp).Unix()] = struct{}{}
+	}
+	for jiaIsuUUID, h := range hours {
+		markConditionRollups(jiaIsuUUID, h)
+	}
+}
+
+// 積まれた時間の集計を定期的に作り直す
+// 作り直すのはこのgoroutineだけなので，古い数え直しの結果で上書きすることはない
+func conditionRollupWorker(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	t := time.NewTicker(conditionRollupInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		processConditionRollups()
+	}
+}
+
+// 頼まれた作り直しと積まれた時間の集計をまとめて作り直す
+// 作り直せなかったものは積んだままにして次の機会に作り直す
+func processConditionRollups() {
+	conditionRollupQueue.Lock()
+	backfill := conditionRollupQueue.backfill
+	conditionRollupQueue.Unlock()
+	if backfill != 0 {
+		rollups, err := backfillConditionRollups()
+		if err != nil {
+			log.Errorf("failed to backfill condition rollup: %v", err)
+			return
+		}
+		log.Infof("rebuilt %d hourly condition rollups", rollups)
+
+		// 作り直している間にまた頼まれたら次の機会にもう一度作り直す
+		conditionRollupQueue.Lock()
+		if conditionRollupQueue.backfill == backfill {
+			conditionRollupQueue.backfill = 0
+		}
+		conditionRollupQueue.Unlock()
+	}
+
+	conditionRollupQueue.Lock()
+	snapshot := make(map[string]map[int64]uint64, len(conditionRollupQueue.hours))
+	for jiaIsuUUID, hours := range conditionRollupQueue.hours {
+		h := make(map[int64]uint64, len(hours))
+		for hour, seq := range hours {
+			h[hour] = seq
+		}
+		snapshot[jiaIsuUUID] = h
+	}
+	conditionRollupQueue.Unlock()
+
+	for jiaIsuUUID, hours := range snapshot {
+		err := rebuildConditionRollups(jiaIsuUUID, hours)
+		if err != nil {
+			log.Errorf("failed to update condition rollup of %s: %v", jiaIsuUUID, err)
+			continue
+		}
+
+		// 数え直している間に積まれ直した時間は残しておく
+		conditionRollupQueue.Lock()
+		pending := conditionRollupQueue.hours[jiaIsuUUID]
+		for hour, seq := range hours {
+			if pending[hour] == seq {
+				delete(pending, hour)
+			}
+		}
+		if len(pending) == 0 {
+			delete(conditionRollupQueue.hours, jiaIsuUUID)
+		}
+		conditionRollupQueue.Unlock()
+	}
+}
+
+// 時間毎の集計をisu_conditionから数え直して書き込む
+// 重複して書き込まれても結果が変わらないよう，足し込まずに毎回数え直す
+func rebuildConditionRollups(jiaIsuUUID string, hours map[int64]uint64) error {
+	var first, last int64
+	for hour := range hours {
+		if first == 0 || hour < first {
+			first = hour
+		}
+		if hour > last {
+			last = hour
+		}
+	}
+
+	var character string
+	err := db.Get(&character, "SELECT IFNULL(`character`, '') FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	conditions := []IsuCondition{}
+	err = db.Select(&conditions,
+		"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` >= ? AND `timestamp` < ? ORDER BY `timestamp` ASC",
+		jiaIsuUUID, time.Unix(first, 0), time.Unix(last, 0).Add(time.Hour))
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	schema := conditionSchemas.ForIsu(jiaIsuUUID)
+	aggregates := map[int64]*graphAggregate{}
+	for _, condition := range conditions {
+		hour := conditionRollupHour(condition.Timestamp).Unix()
+		if _, ok := hours[hour]; !ok {
+			continue
+		}
+		a, ok := aggregates[hour]
+		if !ok {
+			a = newGraphAggregate(schema)
+			aggregates[hour] = a
+		}
+		a.add(schema, condition, character)
+	}
+
+	rollups := []conditionRollup{}
+	for hour, a := range aggregates {
+		r, err := newConditionRollup(jiaIsuUUID, time.Unix(hour, 0), a)
+		if err != nil {
+			return err
+		}
+		rollups = append(rollups, r)
+	}
+	return writeConditionRollups(db, rollups)
+}
+
+// isu_conditionの全てのコンディションから集計を作り直す
+// 作った集計の行数を返す
+func backfillConditionRollups() (int64, error) {
+	_, err := db.Exec("DELETE FROM `isu_condition_hourly`")
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+
+	rows, err := db.Queryx(
+		"SELECT `isu_condition`.*, IFNULL(`isu`.`character`, '') AS `character` FROM `isu_condition`" +
+			" INNER JOIN `isu` ON `isu`.`jia_isu_uuid` = `isu_condition`.`jia_isu_uuid`" +
+			" ORDER BY `isu_condition`.`jia_isu_uuid`, `isu_condition`.`timestamp`")
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	var written int64
+	pending := []conditionRollup{}
+	var current *graphAggregate
+	var currentUUID string
+	var currentHour time.Time
+	flushCurrent := func() error {
+		if current == nil {
+			return nil
+		}
+		r, err := newConditionRollup(currentUUID, currentHour, current)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, r)
+		if len(pending) >= conditionRollupWriteBatchSize {
+			err = writeConditionRollups(db, pending)
+			if err != nil {
+				return err
+			}
+			written += int64(len(pending))
+			pending = []conditionRollup{}
+		}
+		return nil
+	}
+
+	for rows.Next() {
+		var row struct {
+			IsuCondition
+			Character string `db:"character"`
+		}
+		err = rows.StructScan(&row)
+		if err != nil {
+			return written, fmt.Errorf("db error: %v", err)
+		}
+
+		hour := conditionRollupHour(row.Timestamp)
+		if current == nil || row.JIAIsuUUID != currentUUID || !hour.Equal(currentHour) {
+			err = flushCurrent()
+			if err != nil {
+				return written, err
+			}
+			current = newGraphAggregate(conditionSchemas.ForIsu(row.JIAIsuUUID))
+			currentUUID = row.JIAIsuUUID
+			currentHour = hour
+		}
+		current.add(conditionSchemas.ForIsu(row.JIAIsuUUID), row.IsuCondition, row.Character)
+	}
+	if err = rows.Err(); err != nil {
+		return written, fmt.Errorf("db error: %v", err)
+	}
+
+	err = flushCurrent()
+	if err != nil {
+		return written, err
+	}
+	err = writeConditionRollups(db, pending)
+	if err != nil {
+		return written, err
+	}
+	return written + int64(len(pending)), nil
+}
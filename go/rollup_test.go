@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionRollupHour(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		t        string
+		want     string
+	}{
+		{name: "tokyo", location: "Asia/Tokyo", t: "2021-08-01T09:42:10+09:00", want: "2021-08-01T09:00:00+09:00"},
+		{name: "kolkata", location: "Asia/Kolkata", t: "2021-08-01T09:42:10+05:30", want: "2021-08-01T09:00:00+05:30"},
+		{name: "kolkata before half past", location: "Asia/Kolkata", t: "2021-08-01T04:10:00Z", want: "2021-08-01T09:00:00+05:30"},
+		{name: "utc", location: "UTC", t: "2021-08-01T09:42:10+05:30", want: "2021-08-01T04:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prev := storageLocation
+			storageLocation = loc
+			defer func() { storageLocation = prev }()
+
+			ts, _ := time.Parse(time.RFC3339, tt.t)
+			want, _ := time.Parse(time.RFC3339, tt.want)
+			if got := conditionRollupHour(ts); !got.Equal(want) {
+				t.Errorf("conditionRollupHour(%s) = %s, want %s", tt.t, got.In(loc), want.In(loc))
+			}
+		})
+	}
+}
+
+type testRollupRow struct {
+	count, info, warning, critical int64
+}
+
+// rebuildConditionRollupsの読み書きを手元のコンディションで行う
+// beforeSelectがあればisu_conditionを読む前に呼ぶ
+func rollupHandler(conditions []IsuCondition, written map[int64]testRollupRow, beforeSelect func()) fakeDBHandler {
+	return func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT IFNULL(`character`, '') FROM `isu`"):
+			return fakeResult{columns: []string{"character"}, rows: [][]driver.Value{{"いじっぱり"}}}, nil
+		case strings.HasPrefix(query, "SELECT * FROM `isu_condition`"):
+			if beforeSelect != nil {
+				beforeSelect()
+			}
+			start, end := args[1].(time.Time), args[2].(time.Time)
+			matched := []IsuCondition{}
+			for _, c := range conditions {
+				if !c.Timestamp.Before(start) && c.Timestamp.Before(end) {
+					matched = append(matched, c)
+				}
+			}
+			return fakeResult{columns: isuConditionColumns, rows: isuConditionRows(matched)}, nil
+		case strings.HasPrefix(query, "INSERT INTO `isu_condition_hourly`"):
+			for i := 0; i+8 < len(args); i += 9 {
+				written[args[i+1].(time.Time).Unix()] = testRollupRow{
+					count: args[i+2].(int64), info: args[i+4].(int64), warning: args[i+5].(int64), critical: args[i+6].(int64),
+				}
+			}
+			return fakeResult{affected: int64(len(args) / 9)}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+// 積まれた時間だけをisu_conditionから数え直す
+func TestRebuildConditionRollups(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+	prev := storageLocation
+	storageLocation = time.UTC
+	defer func() { storageLocation = prev }()
+
+	base := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	condition := func(offset time.Duration, conditionStr string) IsuCondition {
+		return IsuCondition{JIAIsuUUID: jiaIsuUUID, Timestamp: base.Add(offset), Condition: conditionStr}
+	}
+	conditions := []IsuCondition{
+		condition(10*time.Minute, "is_dirty=false,is_overweight=false,is_broken=false"),
+		condition(20*time.Minute, "is_dirty=true,is_overweight=false,is_broken=false"),
+		condition(70*time.Minute, "is_dirty=true,is_overweight=true,is_broken=true"),
+		condition(130*time.Minute, "is_dirty=false,is_overweight=false,is_broken=false"),
+	}
+	hour := func(h int) int64 { return base.Add(time.Duration(h) * time.Hour).Unix() }
+
+	tests := []struct {
+		name  string
+		hours []int64
+		want  map[int64]testRollupRow
+	}{
+		{
+			name:  "one hour",
+			hours: []int64{hour(0)},
+			want:  map[int64]testRollupRow{hour(0): {count: 2, info: 1, warning: 1}},
+		},
+		{
+			name:  "skipped hour",
+			hours: []int64{hour(0), hour(2)},
+			want: map[int64]testRollupRow{
+				hour(0): {count: 2, info: 1, warning: 1},
+				hour(2): {count: 1, info: 1},
+			},
+		},
+		{
+			name:  "all hours",
+			hours: []int64{hour(0), hour(1), hour(2)},
+			want: map[int64]testRollupRow{
+				hour(0): {count: 2, info: 1, warning: 1},
+				hour(1): {count: 1, critical: 1},
+				hour(2): {count: 1, info: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := map[int64]testRollupRow{}
+			useFakeDB(t, rollupHandler(conditions, written, nil))
+
+			hours := map[int64]uint64{}
+			for i, h := range tt.hours {
+				hours[h] = uint64(i + 1)
+			}
+			err := rebuildConditionRollups(jiaIsuUUID, hours)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(written, tt.want) {
+				t.Errorf("written = %+v, want %+v", written, tt.want)
+			}
+		})
+	}
+}
+
+// 数え直している間に積まれ直した時間は次の機会にもう一度数え直す
+func TestProcessConditionRollups(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+	prev := storageLocation
+	storageLocation = time.UTC
+	defer func() { storageLocation = prev }()
+
+	base := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	conditions := []IsuCondition{
+		{JIAIsuUUID: jiaIsuUUID, Timestamp: base.Add(10 * time.Minute), Condition: "is_dirty=false,is_overweight=false,is_broken=false"},
+	}
+
+	tests := []struct {
+		name        string
+		markAgain   bool
+		wantPending bool
+	}{
+		{name: "not marked again", markAgain: false, wantPending: false},
+		{name: "marked again while rebuilding", markAgain: true, wantPending: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditionRollupQueue.Lock()
+			conditionRollupQueue.hours = map[string]map[int64]uint64{}
+			conditionRollupQueue.backfill = 0
+			conditionRollupQueue.Unlock()
+
+			var beforeSelect func()
+			if tt.markAgain {
+				beforeSelect = func() { updateConditionRollups(conditions) }
+			}
+			useFakeDB(t, rollupHandler(conditions, map[int64]testRollupRow{}, beforeSelect))
+
+			updateConditionRollups(conditions)
+			if _, ok := firstPendingConditionRollup(jiaIsuUUID, base, base.Add(time.Hour)); !ok {
+				t.Fatal("hour was not marked")
+			}
+
+			processConditionRollups()
+			pending, ok := firstPendingConditionRollup(jiaIsuUUID, base, base.Add(time.Hour))
+			if ok != tt.wantPending {
+				t.Fatalf("pending = %v, want %v", ok, tt.wantPending)
+			}
+			if ok && !pending.Equal(base) {
+				t.Errorf("first pending = %s, want %s", pending, base)
+			}
+		})
+	}
+}
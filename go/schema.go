@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const conditionSchemaFetchTimeout = 10 * time.Second
+
+// コンディション文字列に含まれる項目
+type ConditionKey struct {
+	Name string `json:"name"`
+	// trueの時の深刻度
+	Weight int `json:"weight"`
+}
+
+// コンディション文字列の形式とコンディションレベルの判定基準
+type ConditionSchema struct {
+	Keys []ConditionKey `json:"keys"`
+	// trueならキーの順序を問わない
+	OrderInsensitive bool `json:"order_insensitive"`
+	// trueの項目のWeightの合計がこの値以上ならcritical 0なら全項目の合計
+	CriticalWeight int `json:"critical_weight"`
+}
+
+var defaultConditionSchema = ConditionSchema{
+	Keys: []ConditionKey{
+		{Name: "is_dirty", Weight: 1},
+		{Name: "is_overweight", Weight: 1},
+		{Name: "is_broken", Weight: 1},
+	},
+}
+
+// ISUの機種毎に使うスキーマ
+type ConditionSchemaRegistry struct {
+	// どの機種にも割り当てられていないISUのスキーマ
+	Default ConditionSchema `json:"default"`
+	// 機種の名前毎のスキーマ
+	Schemas map[string]ConditionSchema `json:"schemas"`
+	// jia_isu_uuid毎の機種の名前
+	Isus map[string]string `json:"isus"`
+}
+
+var conditionSchemas = ConditionSchemaRegistry{Default: defaultConditionSchema}
+
+// ISUが送ってくるコンディションのスキーマ
+func (r ConditionSchemaRegistry) ForIsu(jiaIsuUUID string) ConditionSchema {
+	if name, ok := r.Isus[jiaIsuUUID]; ok {
+		return r.Schemas[name]
+	}
+	return r.Default
+}
+
+// いずれかのスキーマに含まれる項目か
+func (r ConditionSchemaRegistry) hasKey(name string) bool {
+	if r.Default.hasKey(name) {
+		return true
+	}
+	for _, schema := range r.Schemas {
+		if schema.hasKey(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isu_association_configでスキーマの場所を指定する行の名前
+const conditionSchemaConfigName = "condition_schema"
+
+// JSONファイルからスキーマを読み込む
+// pathが空ならisu_association_configに登録された場所から読み，それも無ければデフォルトのスキーマ
+// 1つのスキーマだけを書いたファイルは全てのISUに使う
+func loadConditionSchemas(path string) (ConditionSchemaRegistry, error) {
+	if path == "" {
+		var err error
+		path, err = getConditionSchemaLocation()
+		if err != nil {
+			return ConditionSchemaRegistry{}, err
+		}
+	}
+	if path == "" {
+		return ConditionSchemaRegistry{Default: defaultConditionSchema}, nil
+	}
+
+	b, err := readConditionSchema(path)
+	if err != nil {
+		return ConditionSchemaRegistry{}, fmt.Errorf("failed to read condition schema: %v", err)
+	}
+	var file struct {
+		ConditionSchemaRegistry
+		Keys []ConditionKey `json:"keys"`
+	}
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return ConditionSchemaRegistry{}, fmt.Errorf("failed to parse condition schema: %v", err)
+	}
+	registry := file.ConditionSchemaRegistry
+	if len(file.Keys) > 0 {
+		var schema ConditionSchema
+		err = json.Unmarshal(b, &schema)
+		if err != nil {
+			return ConditionSchemaRegistry{}, fmt.Errorf("failed to parse condition schema: %v", err)
+		}
+		registry = ConditionSchemaRegistry{Default: schema}
+	}
+	if len(registry.Default.Keys) == 0 {
+		registry.Default = defaultConditionSchema
+	}
+
+	err = registry.Default.validate()
+	if err != nil {
+		return ConditionSchemaRegistry{}, fmt.Errorf("invalid condition schema: %v", err)
+	}
+	for name, schema := range registry.Schemas {
+		err = schema.validate()
+		if err != nil {
+			return ConditionSchemaRegistry{}, fmt.Errorf("invalid condition schema %q: %v", name, err)
+		}
+	}
+	for jiaIsuUUID, name := range registry.Isus {
+		if _, ok := registry.Schemas[name]; !ok {
+			return ConditionSchemaRegistry{}, fmt.Errorf("invalid condition schema: unknown schema %q for %s", name, jiaIsuUUID)
+		}
+	}
+
+	return registry, nil
+}
+
+func (s ConditionSchema) validate() error {
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+	seen := map[string]struct{}{}
+	total := 0
+	for _, key := range s.Keys {
+		if key.Name == "" || strings.ContainsAny(key.Name, ",=") {
+			return fmt.Errorf("bad key %q", key.Name)
+		}
+		if _, ok := seen[key.Name]; ok {
+			return fmt.Errorf("duplicated key %q", key.Name)
+		}
+		if key.Weight < 0 {
+			return fmt.Errorf("negative weight of %q", key.Name)
+		}
+		seen[key.Name] = struct{}{}
+		total += key.Weight
+	}
+	// 重みが全て0だとtrueの項目が一つでもあればcriticalになってしまう
+	if total == 0 {
+		return fmt.Errorf("all weights are zero")
+	}
+	if s.CriticalWeight < 0 {
+		return fmt.Errorf("negative critical_weight")
+	}
+	return nil
+}
+
+// isu_association_configに登録されたスキーマの場所 登録されていなければ空
+func getConditionSchemaLocation() (string, error) {
+	var config Config
+	err := db.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", conditionSchemaConfigName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("db error: %v", err)
+	}
+	return config.URL, nil
+}
+
+// ファイルのパスかfile://，http(s)://のURLからスキーマを読む
+func readConditionSchema(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return ioutil.ReadFile(strings.TrimPrefix(location, "file://"))
+	}
+
+	client := http.Client{Timeout: conditionSchemaFetchTimeout}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s ConditionSchema) criticalWeight() int {
+	if s.CriticalWeight > 0 {
+		return s.CriticalWeight
+	}
+	total := 0
+	for _, key := range s.Keys {
+		total += key.Weight
+	}
+	return total
+}
+
+// "key=true,key=false,..." の形式の文字列を項目毎の値に変換
+func (s ConditionSchema) Parse(conditionStr string) (map[string]bool, error) {
+	pairs := strings.Split(conditionStr, ",")
+	if len(pairs) != len(s.Keys) {
+		return nil, fmt.Errorf("invalid condition format: wrong number of keys")
+	}
+
+	values := make(map[string]bool, len(s.Keys))
+	for i, pair := range pairs {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid condition format: %q", pair)
+		}
+		name := keyValue[0]
+
+		if s.OrderInsensitive {
+			if !s.hasKey(name) {
+				return nil, fmt.Errorf("invalid condition format: unknown key %q", name)
+			}
+			if _, ok := values[name]; ok {
+				return nil, fmt.Errorf("invalid condition format: duplicated key %q", name)
+			}
+		} else if name != s.Keys[i].Name {
+			return nil, fmt.Errorf("invalid condition format: unexpected key %q", name)
+		}
+
+		switch keyValue[1] {
+		case "true":
+			values[name] = true
+		case "false":
+			values[name] = false
+		default:
+			return nil, fmt.Errorf("invalid condition format: %q", pair)
+		}
+	}
+
+	return values, nil
+}
+
+// 保存済みのコンディション文字列を項目毎の値に変換
+// スキーマが変わった後の古い行も読めるよう，スキーマに無い項目や壊れた項目は無視し，足りない項目はfalseとする
+func (s ConditionSchema) ParseStored(conditionStr string) map[string]bool {
+	values := make(map[string]bool, len(s.Keys))
+	for _, key := range s.Keys {
+		values[key.Name] = false
+	}
+	for _, pair := range strings.Split(conditionStr, ",") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		if _, ok := values[keyValue[0]]; ok && keyValue[1] == "true" {
+			values[keyValue[0]] = true
+		}
+	}
+	return values
+}
+
+func (s ConditionSchema) hasKey(name string) bool {
+	for _, key := range s.Keys {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 項目毎の値からコンディションレベルを判定
+func (s ConditionSchema) Level(values map[string]bool) string {
+	weight := 0
+	count := 0
+	for _, key := range s.Keys {
+		if values[key.Name] {
+			weight += key.Weight
+			count++
+		}
+	}
+
+	switch {
+	case count == 0:
+		return conditionLevelInfo
+	case weight >= s.criticalWeight():
+		return conditionLevelCritical
+	default:
+		return conditionLevelWarning
+	}
+}
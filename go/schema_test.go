@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testChairSchema = ConditionSchema{
+	Keys: []ConditionKey{
+		{Name: "is_dirty", Weight: 1},
+		{Name: "is_overheated", Weight: 2},
+	},
+	OrderInsensitive: true,
+}
+
+func TestConditionSchemaParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    ConditionSchema
+		condition string
+		want      map[string]bool
+		wantErr   bool
+	}{
+		{
+			name:      "default",
+			schema:    defaultConditionSchema,
+			condition: "is_dirty=true,is_overweight=false,is_broken=true",
+			want:      map[string]bool{"is_dirty": true, "is_overweight": false, "is_broken": true},
+		},
+		{
+			name:      "wrong order",
+			schema:    defaultConditionSchema,
+			condition: "is_overweight=false,is_dirty=true,is_broken=true",
+			wantErr:   true,
+		},
+		{
+			name:      "order insensitive",
+			schema:    testChairSchema,
+			condition: "is_overheated=true,is_dirty=false",
+			want:      map[string]bool{"is_dirty": false, "is_overheated": true},
+		},
+		{
+			name:      "duplicated key",
+			schema:    testChairSchema,
+			condition: "is_dirty=true,is_dirty=false",
+			wantErr:   true,
+		},
+		{
+			name:      "unknown key",
+			schema:    testChairSchema,
+			condition: "is_dirty=true,is_broken=false",
+			wantErr:   true,
+		},
+		{
+			name:      "missing key",
+			schema:    defaultConditionSchema,
+			condition: "is_dirty=true,is_overweight=false",
+			wantErr:   true,
+		},
+		{
+			name:      "bad value",
+			schema:    defaultConditionSchema,
+			condition: "is_dirty=yes,is_overweight=false,is_broken=false",
+			wantErr:   true,
+		},
+		{
+			name:      "no value",
+			schema:    defaultConditionSchema,
+			condition: "is_dirty,is_overweight=false,is_broken=false",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.schema.Parse(tt.condition)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// スキーマが変わる前の行も項目の過不足を許して読める
+func TestConditionSchemaParseStored(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		want      map[string]bool
+	}{
+		{
+			name:      "exact",
+			condition: "is_dirty=true,is_overheated=false",
+			want:      map[string]bool{"is_dirty": true, "is_overheated": false},
+		},
+		{
+			name:      "missing key",
+			condition: "is_overheated=true",
+			want:      map[string]bool{"is_dirty": false, "is_overheated": true},
+		},
+		{
+			name:      "extra key",
+			condition: "is_dirty=true,is_overweight=true,is_broken=true",
+			want:      map[string]bool{"is_dirty": true, "is_overheated": false},
+		},
+		{
+			name:      "malformed pairs",
+			condition: "is_dirty,is_overheated=maybe,",
+			want:      map[string]bool{"is_dirty": false, "is_overheated": false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testChairSchema.ParseStored(tt.condition); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseStored() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConditionSchemas(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+		// jiaIsuUUIDのISUに使うスキーマの項目
+		wantKeys []string
+		// それ以外のISUに使うスキーマの項目
+		wantDefaultKeys []string
+	}{
+		{
+			name:            "single schema",
+			file:            `{"keys":[{"name":"is_dirty","weight":1},{"name":"is_overheated","weight":2}]}`,
+			wantKeys:        []string{"is_dirty", "is_overheated"},
+			wantDefaultKeys: []string{"is_dirty", "is_overheated"},
+		},
+		{
+			name: "per isu",
+			file: `{"schemas":{"chair-v2":{"keys":[{"name":"is_overheated","weight":1}]}},` +
+				`"isus":{"` + jiaIsuUUID + `":"chair-v2"}}`,
+			wantKeys:        []string{"is_overheated"},
+			wantDefaultKeys: []string{"is_dirty", "is_overweight", "is_broken"},
+		},
+		{
+			name:    "unknown schema",
+			file:    `{"schemas":{},"isus":{"` + jiaIsuUUID + `":"chair-v2"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicated key",
+			file:    `{"keys":[{"name":"is_dirty","weight":1},{"name":"is_dirty","weight":1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad key",
+			file:    `{"keys":[{"name":"is=dirty","weight":1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "zero weights",
+			file:    `{"schemas":{"chair-v2":{"keys":[{"name":"is_dirty","weight":0}]}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "broken json",
+			file:    `{"keys":`,
+			wantErr: true,
+		},
+	}
+
+	keyNames := func(schema ConditionSchema) []string {
+		names := []string{}
+		for _, key := range schema.Keys {
+			names = append(names, key.Name)
+		}
+		return names
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "schema.json")
+			err := os.WriteFile(path, []byte(tt.file), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			registry, err := loadConditionSchemas(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConditionSchemas() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := keyNames(registry.ForIsu(jiaIsuUUID)); !reflect.DeepEqual(got, tt.wantKeys) {
+				t.Errorf("keys of %s = %v, want %v", jiaIsuUUID, got, tt.wantKeys)
+			}
+			if got := keyNames(registry.ForIsu("other")); !reflect.DeepEqual(got, tt.wantDefaultKeys) {
+				t.Errorf("default keys = %v, want %v", got, tt.wantDefaultKeys)
+			}
+		})
+	}
+}
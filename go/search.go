@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type SearchConditionsResponse struct {
+	JIAIsuUUID string                     `json:"jia_isu_uuid"`
+	IsuName    string                     `json:"isu_name"`
+	Conditions []*GetIsuConditionResponse `json:"conditions"`
+}
+
+// コンディションの検索条件 空のものは絞り込まない
+type conditionSearchQuery struct {
+	// messageに含まれる文字列
+	message string
+	// messageに全て含まれる単語
+	tokens []string
+	// コンディションの項目毎の値
+	flags     map[string]bool
+	isSitting *bool
+	startTime time.Time
+	endTime   time.Time
+	cursor    *conditionCursor
+	limit     int
+}
+
+func parseConditionSearchQuery(c echo.Context) (conditionSearchQuery, string) {
+	q := conditionSearchQuery{
+		message: c.QueryParam("message"),
+		tokens:  strings.Fields(c.QueryParam("tokens")),
+		limit:   conditionLimit,
+	}
+
+	if conditionStr := c.QueryParam("condition"); conditionStr != "" {
+		q.flags = map[string]bool{}
+		for _, pair := range strings.Split(conditionStr, ",") {
+			keyValue := strings.SplitN(pair, "=", 2)
+			if len(keyValue) != 2 || !conditionSchemas.hasKey(keyValue[0]) {
+				return conditionSearchQuery{}, "bad format: condition"
+			}
+			v, err := strconv.ParseBool(keyValue[1])
+			if err != nil {
+				return conditionSearchQuery{}, "bad format: condition"
+			}
+			q.flags[keyValue[0]] = v
+		}
+	}
+
+	if isSittingStr := c.QueryParam("is_sitting"); isSittingStr != "" {
+		isSitting, err := strconv.ParseBool(isSittingStr)
+		if err != nil {
+			return conditionSearchQuery{}, "bad format: is_sitting"
+		}
+		q.isSitting = &isSitting
+	}
+
+	if startTimeStr := c.QueryParam("start_time"); startTimeStr != "" {
+		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
+		if err != nil {
+			return conditionSearchQuery{}, "bad format: start_time"
+		}
+		q.startTime = time.Unix(startTimeInt64, 0)
+	}
+	if endTimeStr := c.QueryParam("end_time"); endTimeStr != "" {
+		endTimeInt64, err := strconv.ParseInt(endTimeStr, 10, 64)
+		if err != nil {
+			return conditionSearchQuery{}, "bad format: end_time"
+		}
+		q.endTime = time.Unix(endTimeInt64, 0)
+	}
+
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > conditionMaxLimit {
+			return conditionSearchQuery{}, "bad format: limit"
+		}
+		q.limit = limit
+	}
+
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		cursor, err := decodeConditionCursor(cursorStr)
+		if err != nil {
+			return conditionSearchQuery{}, "bad format: cursor"
+		}
+		q.cursor = &cursor
+	}
+
+	return q, ""
+}
+
+const (
+	// ft_messageのngramの長さ これより短い語は索引で引けない
+	messageNgramTokenSize = 2
+	// ft_conditionの既定のパーサーが索引に入れる最短の語の長さ
+	conditionFulltextMinTokenSize = 3
+)
+
+// LIKEの中で文字通りに一致させる
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// 全てのフレーズを含むものを探すMATCH ... AGAINSTのブール検索の式
+// 索引で引けないフレーズは除き，それらはLIKEだけで絞り込む 一つも無ければ空
+func fulltextAllPhrases(phrases []string, usable func(string) bool) string {
+	terms := []string{}
+	for _, phrase := range phrases {
+		if strings.Contains(phrase, `"`) || !usable(phrase) {
+			continue
+		}
+		terms = append(terms, `+"`+phrase+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func isMessageFulltextPhrase(phrase string) bool {
+	return utf8.RuneCountInString(strings.TrimSpace(phrase)) >= messageNgramTokenSize
+}
+
+// "key=value"は既定のパーサーで"key"と"value"の並びになる
+func isConditionFulltextPhrase(phrase string) bool {
+	for _, word := range strings.Split(phrase, " ") {
+		if len(word) < conditionFulltextMinTokenSize {
+			return false
+		}
+		for _, r := range word {
+			if !(r == '_' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ユーザーの全てのコンディションを新しい順に検索する
+// messageと項目の値はFULLTEXTの索引で候補を絞り，LIKEで文字通りに一致するものだけを残す
+// その他の条件はISU毎に主キーを新しい順に辿りながら絞り込み，1ページ分だけ取り出して最後にまとめて並べ直す
+func searchConditionsFromDB(db *sqlx.DB, jiaUserID string, q conditionSearchQuery) ([]SearchConditionsResponse, *conditionCursor, error) {
+	isus := []Isu{}
+	err := db.Select(&isus, "SELECT `jia_isu_uuid`, `name` FROM `isu` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	if len(isus) == 0 {
+		return []SearchConditionsResponse{}, nil, nil
+	}
+	isuNames := map[string]string{}
+	for _, isu := range isus {
+		isuNames[isu.JIAIsuUUID] = isu.Name
+	}
+
+	filter := ""
+	filterArgs := []interface{}{}
+	messagePhrases := []string{}
+	if q.message != "" {
+		messagePhrases = append(messagePhrases, q.message)
+	}
+	messagePhrases = append(messagePhrases, q.tokens...)
+	if against := fulltextAllPhrases(messagePhrases, isMessageFulltextPhrase); against != "" {
+		filter += " AND MATCH(`message`) AGAINST(? IN BOOLEAN MODE)"
+		filterArgs = append(filterArgs, against)
+	}
+	for _, phrase := range messagePhrases {
+		filter += " AND `message` LIKE ?"
+		filterArgs = append(filterArgs, "%"+escapeLike(phrase)+"%")
+	}
+
+	// キーの順序を問わないスキーマもあるので項目単位で照合する
+	flagPhrases := []string{}
+	for name, v := range q.flags {
+		flagPhrases = append(flagPhrases, fmt.Sprintf("%s %t", name, v))
+	}
+	if against := fulltextAllPhrases(flagPhrases, isConditionFulltextPhrase); against != "" {
+		filter += " AND MATCH(`condition`) AGAINST(? IN BOOLEAN MODE)"
+		filterArgs = append(filterArgs, against)
+	}
+	for name, v := range q.flags {
+		filter += " AND CONCAT(',', `condition`, ',') LIKE ?"
+		filterArgs = append(filterArgs, "%,"+escapeLike(fmt.Sprintf("%s=%t", name, v))+",%")
+	}
+	if q.isSitting != nil {
+		filter += " AND `is_sitting` = ?"
+		filterArgs = append(filterArgs, *q.isSitting)
+	}
+	if !q.startTime.IsZero() {
+		filter += " AND ? <= `timestamp`"
+		filterArgs = append(filterArgs, q.startTime)
+	}
+	if !q.endTime.IsZero() {
+		filter += " AND `timestamp` < ?"
+		filterArgs = append(filterArgs, q.endTime)
+	}
+
+	// 続きがあるか分かるように1件多く取得する
+	subqueries := make([]string, 0, len(isus))
+	args := []interface{}{}
+	for _, isu := range isus {
+		subquery := "(SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ?" + filter
+		args = append(args, isu.JIAIsuUUID)
+		args = append(args, filterArgs...)
+		if q.cursor != nil {
+			// (timestamp, jia_isu_uuid)がカーソルより前のもの ISUが決まっているので時刻の範囲になる
+			if isu.JIAIsuUUID < q.cursor.JIAIsuUUID {
+				subquery += " AND `timestamp` <= ?"
+			} else {
+				subquery += " AND `timestamp` < ?"
+			}
+			args = append(args, time.Unix(q.cursor.Timestamp, 0))
+		}
+		subquery += " ORDER BY `timestamp` DESC LIMIT ?)"
+		args = append(args, q.limit+1)
+		subqueries = append(subqueries, subquery)
+	}
+	query := strings.Join(subqueries, " UNION ALL ") +
+		" ORDER BY `timestamp` DESC, `jia_isu_uuid` DESC LIMIT ?"
+	args = append(args, q.limit+1)
+
+	rows := []IsuCondition{}
+	err = db.Select(&rows, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+
+	var next *conditionCursor
+	if len(rows) > q.limit {
+		rows = rows[:q.limit]
+		last := rows[len(rows)-1]
+		next = &conditionCursor{Timestamp: last.Timestamp.Unix(), JIAIsuUUID: last.JIAIsuUUID}
+	}
+
+	// 最新の一致が新しいISUから順に並べる
+	res := []SearchConditionsResponse{}
+	index := map[string]int{}
+	for _, row := range rows {
+		i, ok := index[row.JIAIsuUUID]
+		if !ok {
+			i = len(res)
+			index[row.JIAIsuUUID] = i
+			res = append(res, SearchConditionsResponse{
+				JIAIsuUUID: row.JIAIsuUUID,
+				IsuName:    isuNames[row.JIAIsuUUID],
+				Conditions: []*GetIsuConditionResponse{},
+			})
+		}
+		res[i].Conditions = append(res[i].Conditions, &GetIsuConditionResponse{
+			JIAIsuUUID:     row.JIAIsuUUID,
+			IsuName:        isuNames[row.JIAIsuUUID],
+			Timestamp:      row.Timestamp.Unix(),
+			IsSitting:      row.IsSitting,
+			Condition:      row.Condition,
+			ConditionLevel: row.ConditionLevel,
+			Message:        row.Message,
+		})
+	}
+
+	return res, next, nil
+}
+
+// GET /api/condition/search
+// ユーザーの全てのISUのコンディションを検索し，ISU毎にまとめて返す
+func searchConditions(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	q, errMsg := parseConditionSearchQuery(c)
+	if errMsg != "" {
+		return c.String(http.StatusBadRequest, errMsg)
+	}
+
+	loc, ok := parseTimezone(c)
+	if !ok {
+		return c.String(http.StatusBadRequest, "bad format: tz")
+	}
+
+	res, next, err := searchConditionsFromDB(db, jiaUserID, q)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, isu := range res {
+		for _, cond := range isu.Conditions {
+			cond.setLocation(loc)
+		}
+	}
+	if next != nil {
+		c.Response().Header().Set(conditionNextCursorHeader, next.encode())
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	isuSignatureHeader       = "X-Isu-Signature"
+	isuSignaturePrefix       = "sha256="
+	isuConditionSecretLength = 32
+	isuTokenPrefix           = "Bearer "
+)
+
+// ISUからのコンディション送信を認証するための情報
+type isuConditionAuth struct {
+	// activate時に発行した秘密鍵 空の場合は署名なしで登録された古いISU
+	secret string
+	// 受け付けた最新のコンディションの時刻 これ以前のものは再送とみなす
+	lastTimestamp int64
+	// コンディションレベルの判定に使うISUの性格
+	character string
+}
+
+var (
+	isuIDValidMap = struct {
+		validMap map[string]*isuConditionAuth
+		sync.Mutex
+	}{
+		validMap: map[string]*isuConditionAuth{},
+	}
+
+	// 署名もJIAのトークンも付いていない送信を拒否するか
+	// ISUに秘密鍵が行き渡るまでは署名なしの送信も受け付ける
+	requireSignedCondition bool
+)
+
+// ISUがコンディションの署名に使う秘密鍵を発行
+func generateConditionSecret() (string, error) {
+	b := make([]byte, isuConditionSecretLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// リクエストボディのHMAC-SHA256が署名と一致するか検証
+func verifyConditionSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, isuSignaturePrefix) {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, isuSignaturePrefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// JIAが発行したISUのトークンをjiaJWTSigningKeyで検証し，そのISUのものか確かめる
+func verifyConditionToken(jiaIsuUUID string, authorization string) bool {
+	if !strings.HasPrefix(authorization, isuTokenPrefix) {
+		return false
+	}
+	token, err := jwt.Parse(strings.TrimPrefix(authorization, isuTokenPrefix), func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, jwt.NewValidationError(fmt.Sprintf("unexpected signing method: %v", token.Header["alg"]), jwt.ValidationErrorSignatureInvalid)
+		}
+		return jiaJWTSigningKey, nil
+	})
+	if err != nil {
+		return false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	tokenIsuUUID, ok := claims["jia_isu_uuid"].(string)
+	return ok && tokenIsuUUID == jiaIsuUUID
+}
+
+// 送信を認証する 付いている署名かトークンは必ず検証し，どちらもなければrequireSignedConditionに従う
+func authenticateCondition(auth *isuConditionAuth, jiaIsuUUID string, body []byte, signature string, authorization string) (bool, string) {
+	switch {
+	case signature != "":
+		if auth.secret == "" || !verifyConditionSignature(auth.secret, body, signature) {
+			return false, "invalid signature"
+		}
+	case authorization != "":
+		if !verifyConditionToken(jiaIsuUUID, authorization) {
+			return false, "invalid token"
+		}
+	case requireSignedCondition:
+		return false, "unsigned condition"
+	}
+	return true, ""
+}
+
+// ISUの認証情報を取得
+// DBから読み込む間はロックを離すので，他のリクエストが先に登録していればそちらを使う
+func getIsuConditionAuth(jiaIsuUUID string) (*isuConditionAuth, error) {
+	isuIDValidMap.Lock()
+	auth, ok := isuIDValidMap.validMap[jiaIsuUUID]
+	isuIDValidMap.Unlock()
+	if ok {
+		return auth, nil
+	}
+
+	var isu struct {
+		Secret    sql.NullString `db:"condition_secret"`
+		Character sql.NullString `db:"character"`
+	}
+	err := db.Get(&isu, "SELECT `condition_secret`, `character` FROM `isu` WHERE `jia_isu_uuid` = ? LIMIT 1", jiaIsuUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	lastTimestamp, err := getLastConditionTimestamp(jiaIsuUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := &isuConditionAuth{secret: isu.Secret.String, character: isu.Character.String, lastTimestamp: lastTimestamp}
+
+	isuIDValidMap.Lock()
+	defer isuIDValidMap.Unlock()
+
+	if auth, ok := isuIDValidMap.validMap[jiaIsuUUID]; ok {
+		return auth, nil
+	}
+	isuIDValidMap.validMap[jiaIsuUUID] = loaded
+	return loaded, nil
+}
+
+// 受け付け済みの最新のコンディションの時刻をDBから求める
+// 受け付けたものはWALに残り，起動時にリクエストを受ける前にDBへ書き戻すので，再起動しても引き継がれる
+func getLastConditionTimestamp(jiaIsuUUID string) (int64, error) {
+	var lastTimestamp sql.NullTime
+	err := db.Get(&lastTimestamp, "SELECT MAX(`timestamp`) FROM `isu_condition` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	if !lastTimestamp.Valid {
+		return 0, nil
+	}
+	return lastTimestamp.Time.Unix(), nil
+}
+
+// 前回受け付けた時刻より新しいコンディションだけを返して最新の時刻を進める
+// 古いものは再送とみなして捨てる 受け付けられなかった時は戻り値の関数で元に戻す
+func advanceConditionTimestamp(auth *isuConditionAuth, conditions []IsuCondition) ([]IsuCondition, func()) {
+	isuIDValidMap.Lock()
+	defer isuIDValidMap.Unlock()
+
+	prev := auth.lastTimestamp
+	newest := prev
+	fresh := make([]IsuCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		timestamp := condition.Timestamp.Unix()
+		if timestamp <= prev {
+			continue
+		}
+		fresh = append(fresh, condition)
+		if timestamp > newest {
+			newest = timestamp
+		}
+	}
+	if len(fresh) == 0 {
+		return nil, func() {}
+	}
+
+	auth.lastTimestamp = newest
+	return fresh, func() {
+		isuIDValidMap.Lock()
+		defer isuIDValidMap.Unlock()
+
+		if auth.lastTimestamp == newest {
+			auth.lastTimestamp = prev
+		}
+	}
+}
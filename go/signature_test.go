@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testConditionSecret = "5f0ad5e32c2f4bdc8b87f7dcd9c9b6e1"
+
+func signConditionBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return isuSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyConditionSignature(t *testing.T) {
+	body := []byte(`[{"is_sitting":true}]`)
+
+	tests := []struct {
+		name      string
+		signature string
+		want      bool
+	}{
+		{name: "valid", signature: signConditionBody(testConditionSecret, body), want: true},
+		{name: "other secret", signature: signConditionBody("other", body), want: false},
+		{name: "other body", signature: signConditionBody(testConditionSecret, []byte(`[]`)), want: false},
+		{name: "missing prefix", signature: signConditionBody(testConditionSecret, body)[len(isuSignaturePrefix):], want: false},
+		{name: "not hex", signature: isuSignaturePrefix + "zz", want: false},
+		{name: "empty", signature: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyConditionSignature(testConditionSecret, body, tt.signature); got != tt.want {
+				t.Errorf("verifyConditionSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateCondition(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+	body := []byte(`[{"is_sitting":true}]`)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey := jiaJWTSigningKey
+	jiaJWTSigningKey = &key.PublicKey
+	defer func() { jiaJWTSigningKey = signingKey }()
+
+	token := func(key *ecdsa.PrivateKey, uuid string) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"jia_isu_uuid": uuid,
+			"exp":          time.Now().Add(time.Hour).Unix(),
+		}).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return isuTokenPrefix + s
+	}
+
+	tests := []struct {
+		name          string
+		secret        string
+		signature     string
+		authorization string
+		requireSigned bool
+		want          bool
+	}{
+		{name: "signed", secret: testConditionSecret, signature: signConditionBody(testConditionSecret, body), want: true},
+		{name: "bad signature", secret: testConditionSecret, signature: signConditionBody("other", body), want: false},
+		{name: "signature without secret", signature: signConditionBody(testConditionSecret, body), want: false},
+		{name: "jia token", authorization: token(key, jiaIsuUUID), requireSigned: true, want: true},
+		{name: "token of other isu", authorization: token(key, "other"), want: false},
+		{name: "token of other key", authorization: token(otherKey, jiaIsuUUID), want: false},
+		{name: "not bearer", authorization: "Basic dXNlcjpwYXNz", want: false},
+		{name: "unsigned", secret: testConditionSecret, want: true},
+		{name: "unsigned when required", secret: testConditionSecret, requireSigned: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requireSignedCondition = tt.requireSigned
+			defer func() { requireSignedCondition = false }()
+
+			auth := &isuConditionAuth{secret: tt.secret}
+			got, reason := authenticateCondition(auth, jiaIsuUUID, body, tt.signature, tt.authorization)
+			if got != tt.want {
+				t.Errorf("authenticateCondition() = %v (%s), want %v", got, reason, tt.want)
+			}
+		})
+	}
+}
+
+// 受け付け済みの時刻以前のコンディションは再送として捨てる
+func TestAdvanceConditionTimestamp(t *testing.T) {
+	tests := []struct {
+		name          string
+		lastTimestamp int64
+		timestamps    []int64
+		want          []int64
+		wantLast      int64
+	}{
+		{name: "all new", lastTimestamp: 100, timestamps: []int64{101, 103, 102}, want: []int64{101, 103, 102}, wantLast: 103},
+		{name: "replayed", lastTimestamp: 100, timestamps: []int64{99, 100}, want: []int64{}, wantLast: 100},
+		{name: "partially replayed", lastTimestamp: 100, timestamps: []int64{100, 101}, want: []int64{101}, wantLast: 101},
+		{name: "first post", lastTimestamp: 0, timestamps: []int64{1}, want: []int64{1}, wantLast: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions := []IsuCondition{}
+			for _, ts := range tt.timestamps {
+				conditions = append(conditions, IsuCondition{Timestamp: time.Unix(ts, 0)})
+			}
+
+			auth := &isuConditionAuth{lastTimestamp: tt.lastTimestamp}
+			fresh, undo := advanceConditionTimestamp(auth, conditions)
+			got := []int64{}
+			for _, c := range fresh {
+				got = append(got, c.Timestamp.Unix())
+			}
+			if !equalInt64s(got, tt.want) {
+				t.Errorf("fresh = %v, want %v", got, tt.want)
+			}
+			if auth.lastTimestamp != tt.wantLast {
+				t.Errorf("lastTimestamp = %d, want %d", auth.lastTimestamp, tt.wantLast)
+			}
+
+			// 受け付けられなかった時は元に戻る
+			undo()
+			if auth.lastTimestamp != tt.lastTimestamp {
+				t.Errorf("lastTimestamp after undo = %d, want %d", auth.lastTimestamp, tt.lastTimestamp)
+			}
+		})
+	}
+}
+
+func equalInt64s(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
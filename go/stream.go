@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	trendEventBufferSize     = 1024
+	trendSubscriberQueueSize = 64
+	streamHeartbeatInterval  = 15 * time.Second
+)
+
+// ある性格のtrendでのISUの変化
+// 新しく加わったISUはFromが，居なくなったISUはToが空になる
+type TrendChange struct {
+	ID        int    `json:"isu_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type TrendCharacterChange struct {
+	Character string        `json:"character"`
+	Changes   []TrendChange `json:"changes"`
+}
+
+type trendEvent struct {
+	id   uint64
+	data []byte
+}
+
+// trendの変化を購読者に配信する
+// 再接続したクライアントに送るため直近のイベントを保持する
+type trendEventHub struct {
+	// 起動毎に変わる値 イベントIDに含め，再起動前のIDで再開しようとしたクライアントには全体を送り直す
+	epoch       int64
+	buffer      []trendEvent
+	lastID      uint64
+	subscribers map[chan trendEvent]struct{}
+	closed      bool
+	sync.Mutex
+}
+
+var trendEvents = &trendEventHub{
+	epoch:       time.Now().UnixNano(),
+	subscribers: map[chan trendEvent]struct{}{},
+}
+
+// イベントIDは "起動毎の値-連番"
+func (h *trendEventHub) eventID(id uint64) string {
+	return strconv.FormatInt(h.epoch, 10) + "-" + strconv.FormatUint(id, 10)
+}
+
+// 今回の起動で送ったイベントIDなら連番を返す
+func (h *trendEventHub) parseEventID(eventID string) (uint64, bool) {
+	parts := strings.SplitN(eventID, "-", 2)
+	if len(parts) != 2 || parts[0] != strconv.FormatInt(h.epoch, 10) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+type trendLevelAndTimestamp struct {
+	level     string
+	timestamp int64
+}
+
+func trendLevels(t TrendResponse) map[int]trendLevelAndTimestamp {
+	levels := map[int]trendLevelAndTimestamp{}
+	for level, conditions := range map[string][]*TrendCondition{
+		conditionLevelInfo:     t.Info,
+		conditionLevelWarning:  t.Warning,
+		conditionLevelCritical: t.Critical,
+	} {
+		for _, c := range conditions {
+			levels[c.ID] = trendLevelAndTimestamp{level: level, timestamp: c.Timestamp}
+		}
+	}
+	return levels
+}
+
+// 性格毎にレベルが変わったISUと，加わったか居なくなったISUを列挙する
+// 同じレベルのまま新しいコンディションが届いただけでは変化としない
+func diffTrend(old, new []TrendResponse) []TrendCharacterChange {
+	oldByCharacter := map[string]TrendResponse{}
+	for _, t := range old {
+		oldByCharacter[t.Character] = t
+	}
+	newByCharacter := map[string]TrendResponse{}
+	for _, t := range new {
+		newByCharacter[t.Character] = t
+	}
+
+	characters := []string{}
+	for character := range oldByCharacter {
+		characters = append(characters, character)
+	}
+	for character := range newByCharacter {
+		if _, ok := oldByCharacter[character]; !ok {
+			characters = append(characters, character)
+		}
+	}
+	sort.Strings(characters)
+
+	res := []TrendCharacterChange{}
+	for _, character := range characters {
+		oldLevels := trendLevels(oldByCharacter[character])
+		newLevels := trendLevels(newByCharacter[character])
+
+		changes := []TrendChange{}
+		for id, n := range newLevels {
+			o, ok := oldLevels[id]
+			if ok && o.level == n.level {
+				continue
+			}
+			changes = append(changes, TrendChange{ID: id, From: o.level, To: n.level, Timestamp: n.timestamp})
+		}
+		for id, o := range oldLevels {
+			if _, ok := newLevels[id]; !ok {
+				changes = append(changes, TrendChange{ID: id, From: o.level, Timestamp: o.timestamp})
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+		res = append(res, TrendCharacterChange{Character: character, Changes: changes})
+	}
+	return res
+}
+
+// 変化を1件のイベントにして配信する ロックを取った状態で呼ぶ
+func (h *trendEventHub) publish(changes []TrendCharacterChange) {
+	if len(changes) == 0 {
+		return
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		log.Errorf("trend stream: %v", err)
+		return
+	}
+
+	h.lastID++
+	event := trendEvent{id: h.lastID, data: data}
+	h.buffer = append(h.buffer, event)
+	if len(h.buffer) > trendEventBufferSize {
+		h.buffer = h.buffer[len(h.buffer)-trendEventBufferSize:]
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// 追いつけない購読者は切断して再接続させる
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// 購読を始める
+// lastIDより後のイベントがバッファに残っていればmissedで返し，
+// 残っていなければ全体を送り直すためにsnapshotとその時点のIDを返す
+func (h *trendEventHub) subscribe(lastID uint64, resume bool) (ch chan trendEvent, missed []trendEvent, snapshot []TrendResponse, snapshotID uint64) {
+	h.Lock()
+	defer h.Unlock()
+
+	ch = make(chan trendEvent, trendSubscriberQueueSize)
+	if h.closed {
+		close(ch)
+		return ch, nil, nil, 0
+	}
+	h.subscribers[ch] = struct{}{}
+
+	if resume && lastID <= h.lastID && (lastID == h.lastID || (len(h.buffer) > 0 && h.buffer[0].id <= lastID+1)) {
+		for _, event := range h.buffer {
+			if event.id > lastID {
+				missed = append(missed, event)
+			}
+		}
+		return ch, missed, nil, 0
+	}
+
+	trendCache.RLock()
+	snapshot = trendCache.trend
+	trendCache.RUnlock()
+	if snapshot == nil {
+		snapshot = []TrendResponse{}
+	}
+	return ch, nil, snapshot, h.lastID
+}
+
+func (h *trendEventHub) unsubscribe(ch chan trendEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// 全ての購読を終わらせる サーバーの終了時に呼ぶ
+func (h *trendEventHub) closeAll() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func writeSSE(w http.ResponseWriter, id string, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, data)
+	if err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// GET /api/trend/stream
+// trendの変化をServer-Sent Eventsで配信
+// Last-Event-IDで再接続すると取りこぼした変化から送る
+// 再起動前のIDなど今回の起動で送っていないIDなら全体を送り直す
+func getTrendStream(c echo.Context) error {
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	var lastID uint64
+	resume := false
+	if lastEventID != "" {
+		lastID, resume = trendEvents.parseEventID(lastEventID)
+	}
+
+	ch, missed, snapshot, snapshotID := trendEvents.subscribe(lastID, resume)
+	defer trendEvents.unsubscribe(ch)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	if snapshot != nil {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			c.Logger().Error(err)
+			return nil
+		}
+		if writeSSE(res, trendEvents.eventID(snapshotID), "snapshot", data) != nil {
+			return nil
+		}
+	}
+	for _, event := range missed {
+		if writeSSE(res, trendEvents.eventID(event.id), "change", event.data) != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if writeSSE(res, trendEvents.eventID(event.id), "change", event.data) != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(res, ": heartbeat\n\n")
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
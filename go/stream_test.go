@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDiffTrend(t *testing.T) {
+	trend := func(character string, info, warning, critical []*TrendCondition) TrendResponse {
+		return TrendResponse{Character: character, Info: info, Warning: warning, Critical: critical}
+	}
+	c := func(id int, timestamp int64) *TrendCondition {
+		return &TrendCondition{ID: id, Timestamp: timestamp}
+	}
+	none := []*TrendCondition{}
+
+	tests := []struct {
+		name string
+		old  []TrendResponse
+		new  []TrendResponse
+		want []TrendCharacterChange
+	}{
+		{
+			name: "same level with newer condition",
+			old:  []TrendResponse{trend("いじっぱり", []*TrendCondition{c(1, 100)}, none, none)},
+			new:  []TrendResponse{trend("いじっぱり", []*TrendCondition{c(1, 200)}, none, none)},
+			want: []TrendCharacterChange{},
+		},
+		{
+			name: "level changed",
+			old:  []TrendResponse{trend("いじっぱり", []*TrendCondition{c(1, 100)}, none, none)},
+			new:  []TrendResponse{trend("いじっぱり", none, none, []*TrendCondition{c(1, 200)})},
+			want: []TrendCharacterChange{{Character: "いじっぱり", Changes: []TrendChange{
+				{ID: 1, From: conditionLevelInfo, To: conditionLevelCritical, Timestamp: 200},
+			}}},
+		},
+		{
+			name: "added and removed",
+			old:  []TrendResponse{trend("いじっぱり", []*TrendCondition{c(1, 100)}, none, none)},
+			new:  []TrendResponse{trend("いじっぱり", none, []*TrendCondition{c(2, 300)}, none)},
+			want: []TrendCharacterChange{{Character: "いじっぱり", Changes: []TrendChange{
+				{ID: 1, From: conditionLevelInfo, Timestamp: 100},
+				{ID: 2, To: conditionLevelWarning, Timestamp: 300},
+			}}},
+		},
+		{
+			name: "new character",
+			old:  nil,
+			new: []TrendResponse{
+				trend("のんき", []*TrendCondition{c(3, 100)}, none, none),
+				trend("いじっぱり", none, none, none),
+			},
+			want: []TrendCharacterChange{{Character: "のんき", Changes: []TrendChange{
+				{ID: 3, To: conditionLevelInfo, Timestamp: 100},
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffTrend(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffTrend() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 再起動前のIDで再開しようとしたクライアントには全体を送り直す
+func TestTrendEventID(t *testing.T) {
+	h := &trendEventHub{epoch: 1627776000000000000}
+	previous := &trendEventHub{epoch: h.epoch - 1}
+
+	tests := []struct {
+		name       string
+		eventID    string
+		wantID     uint64
+		wantResume bool
+	}{
+		{name: "this boot", eventID: h.eventID(42), wantID: 42, wantResume: true},
+		{name: "previous boot", eventID: previous.eventID(42), wantResume: false},
+		{name: "without epoch", eventID: "42", wantResume: false},
+		{name: "bad sequence", eventID: strconv.FormatInt(h.epoch, 10) + "-x", wantResume: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := h.parseEventID(tt.eventID)
+			if ok != tt.wantResume || id != tt.wantID {
+				t.Errorf("parseEventID(%q) = %d, %v, want %d, %v", tt.eventID, id, ok, tt.wantID, tt.wantResume)
+			}
+		})
+	}
+}
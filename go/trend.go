@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
 )
 
 type TrendResponse struct {
@@ -23,128 +30,479 @@ type TrendCondition struct {
 
 var trendCache = struct {
 	trend []TrendResponse
+	// 最後にDBから読み込んで突き合わせた時刻
+	refreshedAt time.Time
+	lastError   string
+	lastErrorAt time.Time
 	sync.RWMutex
 }{
 	trend: []TrendResponse{},
 }
 
+// これより古いtrendCacheは返さない 0なら制限しない
+var trendMaxStaleness time.Duration
+
+// refreshedAtは突き合わせの度にしか進まないので，突き合わせの間隔より短い制限は付けられない
+// 突き合わせが無効なら鮮度を測れないので制限しない
+func trendStalenessLimit(maxStaleness, reconcileInterval time.Duration) time.Duration {
+	if maxStaleness <= 0 {
+		return 0
+	}
+	if reconcileInterval <= 0 {
+		log.Warnf("trend: TREND_MAX_STALENESS is ignored because TREND_RECONCILE_INTERVAL is disabled")
+		return 0
+	}
+	// 突き合わせはtickerの周期でしか始まらないので2周期分の余裕を持たせる
+	limit := reconcileInterval + 2*trendTickerTime*time.Millisecond
+	if maxStaleness < limit {
+		log.Warnf("trend: TREND_MAX_STALENESS is raised to %s to cover TREND_RECONCILE_INTERVAL", limit)
+		return limit
+	}
+	return maxStaleness
+}
+
+type TrendStatusResponse struct {
+	Trend       []TrendResponse `json:"trend"`
+	RefreshedAt int64           `json:"refreshed_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	LastErrorAt int64           `json:"last_error_at,omitempty"`
+	Stale       bool            `json:"stale"`
+}
+
+// GET /api/trendの絞り込み条件
+type trendFilter struct {
+	// 空なら全ての性格
+	characters map[string]struct{}
+	// これより新しいコンディションのみ
+	since int64
+	// 各レベルの先頭offset件を飛ばしてlimit件まで 0なら制限しない
+	offset int
+	limit  int
+}
+
+func parseTrendFilter(c echo.Context) (trendFilter, string) {
+	filter := trendFilter{}
+
+	if characterCSV := c.QueryParam("character"); characterCSV != "" {
+		filter.characters = map[string]struct{}{}
+		for _, character := range strings.Split(characterCSV, ",") {
+			filter.characters[character] = struct{}{}
+		}
+	}
+
+	since, ok := parseTrendQueryInt(c, "since")
+	if !ok {
+		return trendFilter{}, "bad format: since"
+	}
+	offset, ok := parseTrendQueryInt(c, "offset")
+	if !ok {
+		return trendFilter{}, "bad format: offset"
+	}
+	limit, ok := parseTrendQueryInt(c, "limit")
+	if !ok {
+		return trendFilter{}, "bad format: limit"
+	}
+	filter.since = since
+	filter.offset = int(offset)
+	filter.limit = int(limit)
+
+	return filter, ""
+}
+
+// 省略時は0
+func parseTrendQueryInt(c echo.Context, name string) (int64, bool) {
+	str := c.QueryParam(name)
+	if str == "" {
+		return 0, true
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+func (f trendFilter) isEmpty() bool {
+	return f.characters == nil && f.since == 0 && f.offset == 0 && f.limit == 0
+}
+
+func (f trendFilter) apply(trend []TrendResponse) []TrendResponse {
+	if f.isEmpty() {
+		return trend
+	}
+
+	res := []TrendResponse{}
+	for _, t := range trend {
+		if f.characters != nil {
+			if _, ok := f.characters[t.Character]; !ok {
+				continue
+			}
+		}
+		res = append(res, TrendResponse{
+			Character: t.Character,
+			Info:      f.applyConditions(t.Info),
+			Warning:   f.applyConditions(t.Warning),
+			Critical:  f.applyConditions(t.Critical),
+		})
+	}
+	return res
+}
+
+// 新しい順に並んでいるのでsinceより古いものが出たら打ち切る
+func (f trendFilter) applyConditions(conditions []*TrendCondition) []*TrendCondition {
+	end := len(conditions)
+	if f.since > 0 {
+		end = sort.Search(len(conditions), func(i int) bool {
+			return conditions[i].Timestamp <= f.since
+		})
+	}
+
+	start := f.offset
+	if start > end {
+		start = end
+	}
+	if f.limit > 0 && start+f.limit < end {
+		end = start + f.limit
+	}
+	return conditions[start:end]
+}
+
 // GET /api/trend
 // ISUの性格毎の最新のコンディション情報
 func getTrend(c echo.Context) error {
+	filter, errMessage := parseTrendFilter(c)
+	if errMessage != "" {
+		return c.String(http.StatusBadRequest, errMessage)
+	}
+
 	trendCache.RLock()
 	defer trendCache.RUnlock()
 
-	return c.JSON(http.StatusOK, trendCache.trend)
+	trend := filter.apply(trendCache.trend)
+	stale := trendMaxStaleness > 0 && time.Since(trendCache.refreshedAt) > trendMaxStaleness
+	c.Response().Header().Set("X-Trend-Refreshed-At", strconv.FormatInt(trendCache.refreshedAt.Unix(), 10))
+
+	if c.QueryParam("with_status") == "true" {
+		res := TrendStatusResponse{
+			Trend:       trend,
+			RefreshedAt: trendCache.refreshedAt.Unix(),
+			LastError:   trendCache.lastError,
+			Stale:       stale,
+		}
+		if !trendCache.lastErrorAt.IsZero() {
+			res.LastErrorAt = trendCache.lastErrorAt.Unix()
+		}
+		if stale {
+			return c.JSON(http.StatusServiceUnavailable, res)
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+
+	if stale {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(trendTickerTime/1000+1)))
+		return c.String(http.StatusServiceUnavailable, "trend is stale")
+	}
+	return c.JSON(http.StatusOK, trend)
 }
 
-func resetTrendCacheTicker() {
-	t := time.NewTicker(time.Millisecond * trendTickerTime)
+// trendCacheの更新に失敗したことを記録する
+func recordTrendError(err error) {
+	log.Errorf("trend: %v", err)
 
-	for {
-		<-t.C
+	trendCache.Lock()
+	trendCache.lastError = err.Error()
+	trendCache.lastErrorAt = time.Now()
+	trendCache.Unlock()
+}
+
+// ISU毎の最新のコンディション
+type trendIsu struct {
+	id        int
+	character string
+	// コンディションが無い場合は0
+	timestamp int64
+	level     string
+}
+
+// trendCacheの元になる状態 コミットされたコンディションで少しずつ更新する
+var trendState = struct {
+	isus map[string]*trendIsu
+	// trendCacheを作り直す必要のある性格
+	dirty map[string]struct{}
+	sync.Mutex
+}{
+	isus:  map[string]*trendIsu{},
+	dirty: map[string]struct{}{},
+}
+
+// DBから全てのISUの最新のコンディションを読み込んでtrendCacheを作り直す
+func reconcileTrend(ctx context.Context) error {
+	type isuLatestCondition struct {
+		ID             int            `db:"id"`
+		JIAIsuUUID     string         `db:"jia_isu_uuid"`
+		Character      string         `db:"character"`
+		Timestamp      sql.NullTime   `db:"timestamp"`
+		ConditionLevel sql.NullString `db:"condition_level"`
+	}
+	rows := []isuLatestCondition{}
+	err := db.SelectContext(ctx, &rows,
+		"SELECT `isu`.`id`, `isu`.`jia_isu_uuid`, IFNULL(`isu`.`character`, '') AS `character`,"+
+			" `isu_condition`.`timestamp`, `isu_condition`.`condition_level`"+
+			" FROM `isu`"+
+			" LEFT JOIN (SELECT `jia_isu_uuid`, MAX(`timestamp`) AS `timestamp` FROM `isu_condition` GROUP BY `jia_isu_uuid`) AS `latest`"+
+			"  ON `latest`.`jia_isu_uuid` = `isu`.`jia_isu_uuid`"+
+			" LEFT JOIN `isu_condition`"+
+			"  ON `isu_condition`.`jia_isu_uuid` = `latest`.`jia_isu_uuid` AND `isu_condition`.`timestamp` = `latest`.`timestamp`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	// 差し替えと通知の間に古いtrendで上書きされないよう，trendStateのロックを持ったまま通知する
+	trendState.Lock()
+	defer trendState.Unlock()
 
-		characterList := []Isu{}
-		err := db.Select(&characterList, "SELECT `character` FROM `isu` GROUP BY `character`")
-		if err != nil {
+	// 読み込んでからロックを取るまでに反映されたコンディションや登録されたISUは残し，
+	// ISU毎に新しい方のコンディションを使う
+	isus := make(map[string]*trendIsu, len(rows))
+	for jiaIsuUUID, isu := range trendState.isus {
+		isus[jiaIsuUUID] = isu
+	}
+	for _, row := range rows {
+		isu := &trendIsu{id: row.ID, character: row.Character}
+		if row.Timestamp.Valid {
+			isu.timestamp = row.Timestamp.Time.Unix()
+			isu.level = row.ConditionLevel.String
+		}
+		if current, ok := isus[row.JIAIsuUUID]; ok && current.timestamp > isu.timestamp {
+			isu.timestamp = current.timestamp
+			isu.level = current.level
 		}
+		isus[row.JIAIsuUUID] = isu
+	}
+
+	trendState.isus = isus
+	trendState.dirty = map[string]struct{}{}
+	publishTrend(buildTrendResponses(nil, isus, nil), true)
+	return nil
+}
 
-		res := []TrendResponse{}
+// DBを作り直した時に以前のISUを残さないよう，突き合わせの前に空にする
+func resetTrend() {
+	trendState.Lock()
+	defer trendState.Unlock()
 
-		for _, character := range characterList {
-			isuList := []Isu{}
-			err = db.Select(&isuList,
-				"SELECT `id`, `jia_isu_uuid` FROM `isu` WHERE `character` = ?",
-				character.Character,
-			)
-			if err != nil {
+	trendState.isus = map[string]*trendIsu{}
+	trendState.dirty = map[string]struct{}{}
+}
+
+// 登録されたISUをtrendに加える
+func registerTrendIsu(id int, jiaIsuUUID string, character string) {
+	trendState.Lock()
+	defer trendState.Unlock()
+
+	if _, ok := trendState.isus[jiaIsuUUID]; ok {
+		return
+	}
+	trendState.isus[jiaIsuUUID] = &trendIsu{id: id, character: character}
+	trendState.dirty[character] = struct{}{}
+}
+
+// isu_conditionにコミットされたコンディションでISU毎の最新のコンディションを更新する
+func updateTrendWithConditions(conditions []IsuCondition) {
+	// 起動後に別の経路で登録されたISUは，他の更新を止めないようロックを離して読み込む
+	trendState.Lock()
+	unknown := []string{}
+	for _, condition := range conditions {
+		if _, ok := trendState.isus[condition.JIAIsuUUID]; !ok {
+			unknown = append(unknown, condition.JIAIsuUUID)
+		}
+	}
+	trendState.Unlock()
+
+	// 読み込めなかったISUは次の突き合わせで反映する
+	loaded, err := loadTrendIsus(unknown)
+	if err != nil {
+		recordTrendError(err)
+	}
+
+	trendState.Lock()
+	defer trendState.Unlock()
+
+	for jiaIsuUUID, isu := range loaded {
+		if _, ok := trendState.isus[jiaIsuUUID]; !ok {
+			trendState.isus[jiaIsuUUID] = isu
+		}
+	}
+
+	for _, condition := range conditions {
+		isu, ok := trendState.isus[condition.JIAIsuUUID]
+		if !ok {
+			continue
+		}
+
+		timestamp := condition.Timestamp.Unix()
+		if timestamp <= isu.timestamp {
+			continue
+		}
+		isu.timestamp = timestamp
+		isu.level = condition.ConditionLevel
+		trendState.dirty[isu.character] = struct{}{}
+	}
+}
+
+func loadTrendIsus(jiaIsuUUIDs []string) (map[string]*trendIsu, error) {
+	isus := map[string]*trendIsu{}
+	if len(jiaIsuUUIDs) == 0 {
+		return isus, nil
+	}
+
+	query, params, err := sqlx.In(
+		"SELECT `id`, `jia_isu_uuid`, IFNULL(`character`, '') AS `character` FROM `isu` WHERE `jia_isu_uuid` IN (?)",
+		jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []Isu{}
+	err = db.Select(&rows, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for _, row := range rows {
+		isus[row.JIAIsuUUID] = &trendIsu{id: row.ID, character: row.Character}
+	}
+	return isus, nil
+}
+
+// 性格毎のTrendResponseを作る
+// onlyがnilでなければその性格だけ作り直し，他はcurrentのものを使う
+func buildTrendResponses(current []TrendResponse, isus map[string]*trendIsu, only map[string]struct{}) []TrendResponse {
+	byCharacter := map[string]TrendResponse{}
+	for _, t := range current {
+		if _, ok := only[t.Character]; !ok {
+			byCharacter[t.Character] = t
+		}
+	}
+
+	for _, isu := range isus {
+		if isu.character == "" {
+			continue
+		}
+		if only != nil {
+			if _, ok := only[isu.character]; !ok {
+				continue
+			}
+		}
+
+		t, ok := byCharacter[isu.character]
+		if !ok {
+			t = TrendResponse{
+				Character: isu.character,
+				Info:      []*TrendCondition{},
+				Warning:   []*TrendCondition{},
+				Critical:  []*TrendCondition{},
 			}
+		}
+		if isu.timestamp != 0 {
+			trendCondition := &TrendCondition{ID: isu.id, Timestamp: isu.timestamp}
+			switch isu.level {
+			case conditionLevelInfo:
+				t.Info = append(t.Info, trendCondition)
+			case conditionLevelWarning:
+				t.Warning = append(t.Warning, trendCondition)
+			case conditionLevelCritical:
+				t.Critical = append(t.Critical, trendCondition)
+			}
+		}
+		byCharacter[isu.character] = t
+	}
 
-			// type IsuAndCondition struct {
-			// 	ID                 int       `db:"id"`
-			// 	Timestamp          time.Time `db:"timestamp"`
-			// 	ConditionLevelList string    `db:"condition_level_list"`
-			// }
-			// isuAndConditionList := []IsuAndCondition{}
-			// err = db.Select(&isuAndConditionList,
-			// 	"SELECT isu.id AS id,"+
-			// 		" GROUP_CONCAT(isu_condition.condition_level ORDER BY isu_condition.timestamp DESC) AS condition_level_list,"+
-			// 		" MAX(isu_condition.timestamp) AS timestamp"+
-			// 		" FROM isu"+
-			// 		" INNER JOIN isu_condition ON isu.jia_isu_uuid = isu_condition.jia_isu_uuid"+
-			// 		" WHERE isu.character = ? GROUP BY isu.jia_isu_uuid",
-			// 	character.Character,
-			// )
-
-			characterInfoIsuConditions := []*TrendCondition{}
-			characterWarningIsuConditions := []*TrendCondition{}
-			characterCriticalIsuConditions := []*TrendCondition{}
-
-			// for _, isuAndCondition := range isuAndConditionList {
-			// 	trendCondition := TrendCondition{
-			// 		ID:        isuAndCondition.ID,
-			// 		Timestamp: isuAndCondition.Timestamp.Unix(),
-			// 	}
-			// 	conditionLevel := strings.Split(isuAndCondition.ConditionLevelList, ",")[0]
-			// 	switch conditionLevel {
-			// 	case "info":
-			// 		characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
-			// 	case "warning":
-			// 		characterWarningIsuConditions = append(characterWarningIsuConditions, &trendCondition)
-			// 	case "critical":
-			// 		characterCriticalIsuConditions = append(characterCriticalIsuConditions, &trendCondition)
-			// 	}
-			// }
-
-			for _, isu := range isuList {
-				conditions := []IsuCondition{}
-				err = db.Select(&conditions,
-					"SELECT `timestamp`, `condition_level` FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY timestamp DESC LIMIT 1",
-					isu.JIAIsuUUID,
-				)
-				if err != nil {
-				}
+	res := make([]TrendResponse, 0, len(byCharacter))
+	for character, t := range byCharacter {
+		if _, ok := only[character]; ok || only == nil {
+			sortTrendConditions(t.Info)
+			sortTrendConditions(t.Warning)
+			sortTrendConditions(t.Critical)
+		}
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Character < res[j].Character
+	})
+	return res
+}
 
-				if len(conditions) > 0 {
-					isuLastCondition := conditions[0]
-					// conditionLevel, err := calculateConditionLevel(isuLastCondition.Condition)
-					// if err != nil {
-					// }
-					trendCondition := TrendCondition{
-						ID:        isu.ID,
-						Timestamp: isuLastCondition.Timestamp.Unix(),
-					}
-					switch isuLastCondition.ConditionLevel {
-					case "info":
-						characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
-					case "warning":
-						characterWarningIsuConditions = append(characterWarningIsuConditions, &trendCondition)
-					case "critical":
-						characterCriticalIsuConditions = append(characterCriticalIsuConditions, &trendCondition)
-					}
-				}
+func sortTrendConditions(conditions []*TrendCondition) {
+	sort.Slice(conditions, func(i, j int) bool {
+		return conditions[i].Timestamp > conditions[j].Timestamp
+	})
+}
+
+// 最新のコンディションが変わった性格のtrendCacheだけを作り直す
+func refreshTrendCache() {
+	trendState.Lock()
+	defer trendState.Unlock()
+
+	dirty := trendState.dirty
+	trendState.dirty = map[string]struct{}{}
+	if len(dirty) == 0 {
+		return
+	}
+
+	trendCache.RLock()
+	current := trendCache.trend
+	trendCache.RUnlock()
 
+	// DBを読んでいないのでrefreshedAtは進めない
+	publishTrend(buildTrendResponses(current, trendState.isus, dirty), false)
+}
+
+// trendCacheを差し替えて変化をstreamの購読者に通知する
+// trendStateのロックを取った状態で呼ぶ
+func publishTrend(trend []TrendResponse, refreshed bool) {
+	trendEvents.Lock()
+	defer trendEvents.Unlock()
+
+	trendCache.Lock()
+	old := trendCache.trend
+	trendCache.trend = trend
+	if refreshed {
+		trendCache.refreshedAt = time.Now()
+	}
+	trendCache.Unlock()
+
+	trendEvents.publish(diffTrend(old, trend))
+}
+
+func resetTrendCacheTicker(ctx context.Context, wg *sync.WaitGroup, reconcileInterval time.Duration) {
+	defer wg.Done()
+
+	t := time.NewTicker(time.Millisecond * trendTickerTime)
+	defer t.Stop()
+	lastReconciled := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		start := time.Now()
+
+		// 取りこぼしを直すために定期的にDBと突き合わせる
+		if reconcileInterval > 0 && time.Since(lastReconciled) >= reconcileInterval {
+			err := reconcileTrend(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				recordTrendError(err)
+				continue
 			}
+			lastReconciled = time.Now()
+		} else {
+			refreshTrendCache()
+		}
 
-			sort.Slice(characterInfoIsuConditions, func(i, j int) bool {
-				return characterInfoIsuConditions[i].Timestamp > characterInfoIsuConditions[j].Timestamp
-			})
-			sort.Slice(characterWarningIsuConditions, func(i, j int) bool {
-				return characterWarningIsuConditions[i].Timestamp > characterWarningIsuConditions[j].Timestamp
-			})
-			sort.Slice(characterCriticalIsuConditions, func(i, j int) bool {
-				return characterCriticalIsuConditions[i].Timestamp > characterCriticalIsuConditions[j].Timestamp
-			})
-			res = append(res,
-				TrendResponse{
-					Character: character.Character,
-					Info:      characterInfoIsuConditions,
-					Warning:   characterWarningIsuConditions,
-					Critical:  characterCriticalIsuConditions,
-				})
-		}
-
-		trendCache.Lock()
-		trendCache.trend = res
-		trendCache.Unlock()
+		trendRefreshDuration.Observe(time.Since(start).Seconds())
 	}
 }
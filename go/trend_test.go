@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 突き合わせを読み込んでいる間に反映されたコンディションを古いDBの結果で戻さない
+func TestReconcileTrend(t *testing.T) {
+	type dbRow struct {
+		timestamp int64
+		level     string
+	}
+
+	tests := []struct {
+		name string
+		// 突き合わせの前にメモリにある最新のコンディション nilならISUが無い
+		current *trendIsu
+		// DBの最新のコンディション nilならISUが無い timestampが0ならコンディションが無い
+		db            *dbRow
+		wantTimestamp int64
+		wantLevel     string
+		wantExists    bool
+	}{
+		{
+			name:          "db is newer",
+			current:       &trendIsu{id: 1, character: "いじっぱり", timestamp: 100, level: conditionLevelInfo},
+			db:            &dbRow{timestamp: 200, level: conditionLevelCritical},
+			wantTimestamp: 200, wantLevel: conditionLevelCritical, wantExists: true,
+		},
+		{
+			name:          "memory is newer",
+			current:       &trendIsu{id: 1, character: "いじっぱり", timestamp: 300, level: conditionLevelWarning},
+			db:            &dbRow{timestamp: 200, level: conditionLevelCritical},
+			wantTimestamp: 300, wantLevel: conditionLevelWarning, wantExists: true,
+		},
+		{
+			name:          "no condition in db",
+			current:       &trendIsu{id: 1, character: "いじっぱり", timestamp: 300, level: conditionLevelWarning},
+			db:            &dbRow{},
+			wantTimestamp: 300, wantLevel: conditionLevelWarning, wantExists: true,
+		},
+		{
+			name:          "only in db",
+			db:            &dbRow{timestamp: 200, level: conditionLevelInfo},
+			wantTimestamp: 200, wantLevel: conditionLevelInfo, wantExists: true,
+		},
+		{
+			name:          "registered while reading",
+			current:       &trendIsu{id: 1, character: "いじっぱり"},
+			wantTimestamp: 0, wantExists: true,
+		},
+	}
+
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+				if !strings.HasPrefix(query, "SELECT `isu`.`id`") {
+					return fakeResult{}, fmt.Errorf("unexpected query: %s", query)
+				}
+				res := fakeResult{columns: []string{"id", "jia_isu_uuid", "character", "timestamp", "condition_level"}}
+				if tt.db != nil {
+					var timestamp, level driver.Value
+					if tt.db.timestamp != 0 {
+						timestamp, level = time.Unix(tt.db.timestamp, 0), tt.db.level
+					}
+					res.rows = append(res.rows, []driver.Value{int64(1), jiaIsuUUID, "いじっぱり", timestamp, level})
+				}
+				return res, nil
+			})
+
+			resetTrend()
+			defer resetTrend()
+			if tt.current != nil {
+				current := *tt.current
+				trendState.Lock()
+				trendState.isus[jiaIsuUUID] = &current
+				trendState.Unlock()
+			}
+
+			err := reconcileTrend(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			trendState.Lock()
+			defer trendState.Unlock()
+			isu, ok := trendState.isus[jiaIsuUUID]
+			if ok != tt.wantExists {
+				t.Fatalf("exists = %v, want %v", ok, tt.wantExists)
+			}
+			if isu.timestamp != tt.wantTimestamp || isu.level != tt.wantLevel {
+				t.Errorf("latest = %d %q, want %d %q", isu.timestamp, isu.level, tt.wantTimestamp, tt.wantLevel)
+			}
+		})
+	}
+}
+
+// 古いコンディションが後から届いても最新のものを戻さない
+func TestUpdateTrendWithConditions(t *testing.T) {
+	const jiaIsuUUID = "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f"
+
+	tests := []struct {
+		name          string
+		batches       [][]int64
+		wantTimestamp int64
+		wantDirty     bool
+	}{
+		{name: "in order", batches: [][]int64{{100, 200}}, wantTimestamp: 200, wantDirty: true},
+		{name: "out of order batches", batches: [][]int64{{300}, {200}}, wantTimestamp: 300, wantDirty: true},
+		{name: "not newer", batches: [][]int64{{50}}, wantTimestamp: 100, wantDirty: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTrend()
+			defer resetTrend()
+			trendState.Lock()
+			trendState.isus[jiaIsuUUID] = &trendIsu{id: 1, character: "いじっぱり", timestamp: 100, level: conditionLevelInfo}
+			trendState.Unlock()
+
+			for _, batch := range tt.batches {
+				conditions := []IsuCondition{}
+				for _, ts := range batch {
+					conditions = append(conditions, IsuCondition{
+						JIAIsuUUID: jiaIsuUUID, Timestamp: time.Unix(ts, 0), ConditionLevel: conditionLevelWarning,
+					})
+				}
+				updateTrendWithConditions(conditions)
+			}
+
+			trendState.Lock()
+			defer trendState.Unlock()
+			if got := trendState.isus[jiaIsuUUID].timestamp; got != tt.wantTimestamp {
+				t.Errorf("timestamp = %d, want %d", got, tt.wantTimestamp)
+			}
+			if _, dirty := trendState.dirty["いじっぱり"]; dirty != tt.wantDirty {
+				t.Errorf("dirty = %v, want %v", dirty, tt.wantDirty)
+			}
+		})
+	}
+}
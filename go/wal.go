@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	walSegmentExt        = ".wal"
+	walRecordHeaderBytes = 8
+)
+
+// 受理したコンディションをDBにコミットするまで保持する追記専用ログ
+// セグメントファイルは [長さ(4byte)][CRC32(4byte)][JSON] のレコードの並び
+type conditionWAL struct {
+	dir            string
+	maxSegmentSize int64
+
+	file      *os.File
+	segmentID uint64
+	size      int64
+	// セグメント毎の未コミットのレコード数
+	pending map[uint64]int
+	sync.Mutex
+}
+
+var conditionLog *conditionWAL
+
+// WALのディレクトリを開く
+// 既存のセグメントはReplayで読み出すまで残しておく
+func openConditionWAL(dir string, maxSegmentSize int64) (*conditionWAL, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wal dir: %v", err)
+	}
+
+	ids, err := listWALSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &conditionWAL{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		pending:        map[uint64]int{},
+	}
+	if len(ids) > 0 {
+		w.segmentID = ids[len(ids)-1]
+	}
+	return w, nil
+}
+
+func listWALSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal dir: %v", err)
+	}
+
+	ids := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (w *conditionWAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", id, walSegmentExt))
+}
+
+// 起動前に残っていたセグメントを古い順に読み出してapplyに渡す
+// applyが成功したセグメントは削除する
+func (w *conditionWAL) Replay(apply func([]IsuCondition) error) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	ids, err := listWALSegments(w.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, id := range ids {
+		if w.file != nil && id == w.segmentID {
+			continue
+		}
+
+		conditions, err := readWALSegment(w.segmentPath(id))
+		if err != nil {
+			return replayed, err
+		}
+		if len(conditions) > 0 {
+			err = apply(conditions)
+			if err != nil {
+				return replayed, err
+			}
+		}
+		replayed += len(conditions)
+
+		err = os.Remove(w.segmentPath(id))
+		if err != nil {
+			return replayed, fmt.Errorf("failed to remove wal segment: %v", err)
+		}
+	}
+
+	return replayed, nil
+}
+
+// セグメントからレコードを読み出す
+// 末尾の書きかけレコードやチェックサム不一致以降は捨てる
+func readWALSegment(path string) ([]IsuCondition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal segment: %v", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, walRecordHeaderBytes)
+	conditions := []IsuCondition{}
+	for {
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return conditions, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warnf("wal: truncated record header in %s", path)
+				return conditions, nil
+			}
+			return nil, fmt.Errorf("failed to read wal segment: %v", err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warnf("wal: truncated record in %s", path)
+				return conditions, nil
+			}
+			return nil, fmt.Errorf("failed to read wal segment: %v", err)
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			log.Warnf("wal: checksum mismatch in %s", path)
+			return conditions, nil
+		}
+
+		var condition IsuCondition
+		err = json.Unmarshal(payload, &condition)
+		if err != nil {
+			log.Warnf("wal: broken record in %s: %v", path, err)
+			return conditions, nil
+		}
+		conditions = append(conditions, condition)
+	}
+}
+
+// コンディションをログに追記してfsyncする
+// 書き込んだセグメントのIDを返すので，コミット後にAckに渡すこと
+func (w *conditionWAL) Append(conditions []IsuCondition) (uint64, error) {
+	buf := []byte{}
+	header := make([]byte, walRecordHeaderBytes)
+	for _, condition := range conditions {
+		payload, err := json.Marshal(condition)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode wal record: %v", err)
+		}
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		buf = append(buf, header...)
+		buf = append(buf, payload...)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil || w.size >= w.maxSegmentSize {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err := w.file.Write(buf)
+	if err != nil {
+		w.discardTail()
+		return 0, fmt.Errorf("failed to write wal: %v", err)
+	}
+	err = w.file.Sync()
+	if err != nil {
+		w.discardTail()
+		return 0, fmt.Errorf("failed to sync wal: %v", err)
+	}
+
+	w.size += int64(len(buf))
+	w.pending[w.segmentID] += len(conditions)
+	return w.segmentID, nil
+}
+
+// 書き込みに失敗したレコードをセグメントから取り除く
+// 書きかけのレコードが残るとReplayがそれ以降を読まないので，
+// 切り詰められなければ次の追記から新しいセグメントに切り替える
+func (w *conditionWAL) discardTail() {
+	err := w.file.Truncate(w.size)
+	if err == nil {
+		return
+	}
+	log.Warnf("wal: failed to truncate segment %d: %v", w.segmentID, err)
+
+	err = w.file.Close()
+	if err != nil {
+		log.Warnf("wal: failed to close segment %d: %v", w.segmentID, err)
+	}
+	w.file = nil
+	if w.pending[w.segmentID] == 0 {
+		w.removeSegment(w.segmentID)
+	}
+}
+
+// 新しいセグメントに切り替える
+func (w *conditionWAL) rotate() error {
+	if w.file != nil {
+		err := w.file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close wal segment: %v", err)
+		}
+		w.file = nil
+		if w.pending[w.segmentID] == 0 {
+			w.removeSegment(w.segmentID)
+		}
+	}
+
+	w.segmentID++
+	f, err := os.OpenFile(w.segmentPath(w.segmentID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %v", err)
+	}
+	w.file = f
+	w.size = 0
+	return nil
+}
+
+// DBへのコミットが済んだレコード数をセグメント毎に通知する
+// 全レコードがコミットされた書き込み中でないセグメントは削除する
+func (w *conditionWAL) Ack(counts map[uint64]int) {
+	w.Lock()
+	defer w.Unlock()
+
+	for id, count := range counts {
+		w.pending[id] -= count
+		if w.pending[id] > 0 {
+			continue
+		}
+		delete(w.pending, id)
+		if w.file == nil || id != w.segmentID {
+			w.removeSegment(id)
+		}
+	}
+}
+
+func (w *conditionWAL) removeSegment(id uint64) {
+	err := os.Remove(w.segmentPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("wal: failed to remove segment %d: %v", id, err)
+	}
+}
+
+func (w *conditionWAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	if w.pending[w.segmentID] == 0 {
+		w.removeSegment(w.segmentID)
+	}
+	return err
+}
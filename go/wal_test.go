@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testWALConditions(n int) []IsuCondition {
+	conditions := []IsuCondition{}
+	base := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		conditions = append(conditions, IsuCondition{
+			JIAIsuUUID:     "0694e4d7-dfce-4aec-b7ca-887ac42cfb8f",
+			Timestamp:      base.Add(time.Duration(i) * time.Second),
+			IsSitting:      i%2 == 0,
+			Condition:      "is_dirty=false,is_overweight=false,is_broken=false",
+			Message:        "test",
+			ConditionLevel: conditionLevelInfo,
+			CreatedAt:      base,
+		})
+	}
+	return conditions
+}
+
+// 書きかけや壊れたレコードがあっても，それより前のレコードは復元される
+func TestConditionWALReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, path string)
+		want    int
+	}{
+		{
+			name:    "intact",
+			corrupt: func(t *testing.T, path string) {},
+			want:    3,
+		},
+		{
+			name: "truncated header",
+			corrupt: func(t *testing.T, path string) {
+				appendToFile(t, path, []byte{0, 0, 0})
+			},
+			want: 3,
+		},
+		{
+			name: "truncated payload",
+			corrupt: func(t *testing.T, path string) {
+				truncateFile(t, path, -5)
+			},
+			want: 2,
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(t *testing.T, path string) {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b[len(b)-2] ^= 0xff
+				err = os.WriteFile(path, b, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := openConditionWAL(dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := w.Append(testWALConditions(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := w.segmentPath(id)
+			// 終了時にコミットされていないセグメントは残る
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.corrupt(t, path)
+
+			w, err = openConditionWAL(dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replayed := []IsuCondition{}
+			n, err := w.Replay(func(conditions []IsuCondition) error {
+				replayed = append(replayed, conditions...)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want || len(replayed) != tt.want {
+				t.Fatalf("replayed %d conditions, want %d", n, tt.want)
+			}
+			for i, c := range replayed {
+				want := testWALConditions(3)[i]
+				if !c.Timestamp.Equal(want.Timestamp) || c.IsSitting != want.IsSitting || !c.CreatedAt.Equal(want.CreatedAt) {
+					t.Errorf("replayed condition %d = %+v, want %+v", i, c, want)
+				}
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("replayed segment was not removed: %v", err)
+			}
+		})
+	}
+}
+
+// 全てのレコードがコミットされた書き込み中でないセグメントだけが消える
+func TestConditionWALAck(t *testing.T) {
+	tests := []struct {
+		name string
+		// 1つ目のセグメントでコミットされた件数
+		acked       int
+		wantRemoved bool
+	}{
+		{name: "all acked", acked: 2, wantRemoved: true},
+		{name: "partially acked", acked: 1, wantRemoved: false},
+		{name: "not acked", acked: 0, wantRemoved: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 1レコードでセグメントが一杯になる大きさにして，追記毎に切り替える
+			w, err := openConditionWAL(t.TempDir(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			first, err := w.Append(testWALConditions(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := w.Append(testWALConditions(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == second {
+				t.Fatalf("segment was not rotated")
+			}
+
+			w.Ack(map[uint64]int{first: tt.acked})
+			_, err = os.Stat(w.segmentPath(first))
+			if removed := os.IsNotExist(err); removed != tt.wantRemoved {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+
+			// 書き込み中のセグメントは全てコミットされても消さない
+			w.Ack(map[uint64]int{second: 1})
+			if _, err := os.Stat(w.segmentPath(second)); err != nil {
+				t.Errorf("active segment was removed: %v", err)
+			}
+		})
+	}
+}
+
+func appendToFile(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncateFile(t *testing.T, path string, delta int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, info.Size()+delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
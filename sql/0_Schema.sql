@@ -2,6 +2,14 @@ DROP TABLE IF EXISTS `isu_association_config`;
 
 DROP TABLE IF EXISTS `isu_condition`;
 
+DROP TABLE IF EXISTS `isu_condition_dead_letter`;
+
+DROP TABLE IF EXISTS `isu_condition_hourly`;
+
+DROP TABLE IF EXISTS `alert`;
+
+DROP TABLE IF EXISTS `alert_rule`;
+
 DROP TABLE IF EXISTS `isu`;
 
 DROP TABLE IF EXISTS `user`;
@@ -31,6 +39,56 @@ CREATE TABLE `isu_condition` (
   PRIMARY KEY(`jia_isu_uuid`, `timestamp`)
 ) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
 
+CREATE TABLE `isu_condition_dead_letter` (
+  `id` bigint AUTO_INCREMENT PRIMARY KEY,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` TEXT NOT NULL,
+  `message` TEXT NOT NULL,
+  `condition_level` VARCHAR(10) NOT NULL,
+  `reason` TEXT NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE `isu_condition_hourly` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `hour` DATETIME NOT NULL,
+  `count` INT NOT NULL,
+  `sitting_count` INT NOT NULL,
+  `info_count` INT NOT NULL,
+  `warning_count` INT NOT NULL,
+  `critical_count` INT NOT NULL,
+  `flag_counts` TEXT NOT NULL,
+  `condition_timestamps` MEDIUMTEXT NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `hour`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE `alert_rule` (
+  `id` bigint AUTO_INCREMENT PRIMARY KEY,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `jia_isu_uuid` CHAR(36),
+  `name` VARCHAR(255) NOT NULL,
+  `type` VARCHAR(32) NOT NULL,
+  `condition_key` VARCHAR(255) NOT NULL,
+  `level` VARCHAR(10) NOT NULL,
+  `count` INT NOT NULL,
+  `duration_seconds` INT NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX idx_user_id (`jia_user_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
+CREATE TABLE `alert` (
+  `id` bigint AUTO_INCREMENT PRIMARY KEY,
+  `rule_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `state` VARCHAR(10) NOT NULL,
+  `fired_at` DATETIME NOT NULL,
+  `resolved_at` DATETIME,
+  INDEX idx_rule_state (`rule_id`, `jia_isu_uuid`, `state`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET = utf8mb4;
+
 CREATE TABLE `user` (
   `jia_user_id` VARCHAR(255) PRIMARY KEY,
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
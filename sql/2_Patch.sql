@@ -7,4 +7,17 @@ WHERE `condition` = 'is_dirty=false,is_overweight=false,is_broken=false';
 
 UPDATE `isu_condition`
 SET `condition_level` = 'critical'
-WHERE `condition` = 'is_dirty=true,is_overweight=true,is_broken=true';
\ No newline at end of file
+WHERE `condition` = 'is_dirty=true,is_overweight=true,is_broken=true';
+
+ALTER TABLE `isu`
+ADD `condition_secret` CHAR(64) DEFAULT NULL;
+
+-- 初期データを入れた後にまとめて作る InnoDBは一度に一つしかFULLTEXTの索引を作れない
+-- ngramはストップワードを含む語を索引に入れないので，ストップワードを使わずに作る
+SET SESSION innodb_ft_enable_stopword = OFF;
+
+ALTER TABLE `isu_condition`
+ADD FULLTEXT INDEX `ft_message` (`message`) WITH PARSER ngram;
+
+ALTER TABLE `isu_condition`
+ADD FULLTEXT INDEX `ft_condition` (`condition`);